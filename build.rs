@@ -0,0 +1,65 @@
+//! Record build information reported by the /version endpoint
+
+use std::path::Path;
+use std::process::Command;
+use std::{env, fs};
+
+fn main() {
+    // Version of the compiler building the server
+    let rustc = env::var("RUSTC").unwrap_or_else(|_| "rustc".to_string());
+    let output = Command::new(rustc)
+        .arg("--version")
+        .output()
+        .expect("should be able to run rustc");
+    let rustc_version = String::from_utf8(output.stdout).expect("rustc version should be UTF-8");
+    println!(
+        "cargo:rustc-env=STAR_RANDSRV_RUSTC_VERSION={}",
+        rustc_version.trim()
+    );
+
+    // Version of the ppoprf crate the server links, as locked
+    // Report it as unknown rather than failing the build if the lock
+    // file can't be read, e.g. in a source package shipped without it.
+    let manifest_dir = env::var("CARGO_MANIFEST_DIR").expect("cargo should set the manifest dir");
+    let lock_path = Path::new(&manifest_dir).join("Cargo.lock");
+    let ppoprf_version = fs::read_to_string(&lock_path)
+        .ok()
+        .and_then(|lock| {
+            let fields = lock
+                .split("[[package]]")
+                .map(|package| package.lines().map(str::trim).collect::<Vec<_>>())
+                .find(|fields| fields.contains(&r#"name = "ppoprf""#))?;
+            let version = fields.iter().find_map(|f| f.strip_prefix("version = "))?;
+            Some(version.trim_matches('"').to_string())
+        })
+        .unwrap_or_else(|| "unknown".to_string());
+    println!("cargo:rustc-env=STAR_RANDSRV_PPOPRF_VERSION={ppoprf_version}");
+    println!("cargo:rerun-if-changed=Cargo.lock");
+
+    // Optionally supplied by the builder, and otherwise taken from
+    // git when building from a checkout
+    if env::var_os("STAR_RANDSRV_GIT_COMMIT").is_none() {
+        let commit = Command::new("git")
+            .args(["rev-parse", "HEAD"])
+            .current_dir(&manifest_dir)
+            .output()
+            .ok()
+            .filter(|output| output.status.success())
+            .and_then(|output| String::from_utf8(output.stdout).ok());
+        if let Some(commit) = commit {
+            println!("cargo:rustc-env=STAR_RANDSRV_GIT_COMMIT={}", commit.trim());
+        }
+        let head = Path::new(&manifest_dir).join(".git/HEAD");
+        if let Ok(contents) = fs::read_to_string(&head) {
+            println!("cargo:rerun-if-changed={}", head.display());
+            if let Some(branch) = contents.trim().strip_prefix("ref: ") {
+                let branch = Path::new(&manifest_dir).join(".git").join(branch);
+                if branch.exists() {
+                    println!("cargo:rerun-if-changed={}", branch.display());
+                }
+            }
+        }
+    }
+    println!("cargo:rerun-if-env-changed=STAR_RANDSRV_GIT_COMMIT");
+    println!("cargo:rerun-if-env-changed=STAR_RANDSRV_BUILD_TIME");
+}
@@ -1,24 +1,360 @@
 //! STAR Randomness web service route implementation
 
-use std::sync::RwLockReadGuard;
+use std::any::Any;
+use std::collections::HashSet;
+use std::net::{IpAddr, SocketAddr};
+use std::sync::{atomic::Ordering, RwLock, RwLockReadGuard};
+use std::time::{Duration, Instant};
 
-use axum::extract::{Json, Path, State};
-use axum::http::StatusCode;
-use base64::prelude::{Engine as _, BASE64_STANDARD as BASE64};
-use serde::{Deserialize, Serialize};
-use tracing::{debug, instrument};
+use axum::body::Bytes;
+use axum::extract::rejection::{BytesRejection, JsonRejection, QueryRejection};
+use axum::extract::{ConnectInfo, FromRequest, Json, Path, Query, Request, State};
+use axum::http::{header, HeaderMap, HeaderValue, Method, StatusCode};
+use axum::middleware::Next;
+use axum::response::{IntoResponse, Response};
+use base64::engine::GeneralPurpose;
+use base64::prelude::{
+    Engine as _, BASE64_STANDARD as BASE64, BASE64_STANDARD_NO_PAD, BASE64_URL_SAFE,
+    BASE64_URL_SAFE_NO_PAD,
+};
+use hkdf::Hkdf;
+use metrics::{counter, gauge, histogram};
+use serde::{de::DeserializeOwned, Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use subtle::ConstantTimeEq;
+use time::format_description::well_known::Rfc3339;
+use tokio::sync::OwnedSemaphorePermit;
+use tracing::{debug, error, instrument, warn};
 
-use crate::state::{OPRFInstance, OPRFState};
+use crate::state::{
+    rotation_timestamp, EvalCache, EvalError, OPRFInstance, OPRFServer, OPRFState, RateLimiter,
+};
+use crate::util::parse_timestamp;
 use ppoprf::ppoprf;
+use pprof::protos::Message as _;
 
-/// Request structure for the randomness endpoint
-#[derive(Deserialize, Debug)]
-pub struct RandomnessRequest {
+/// Whether randomness responses can include evaluation proofs
+/// Proofs are returned for requests setting `verifiable`.
+pub const PROOFS_SUPPORTED: bool = true;
+
+/// Group in which the PPOPRF is evaluated
+/// ppoprf doesn't export its ciphersuite, so the `ciphersuite` test
+/// pins the release this was checked against.
+pub const CURVE: &str = "ristretto255";
+
+/// Hash function used by the PPOPRF to map inputs into the group
+/// Checked along with `CURVE`.
+pub const HASH: &str = "SHA-512";
+
+/// Length in bytes of each evaluation output, a compressed point
+pub const OUTPUT_LENGTH: usize = ppoprf::COMPRESSED_POINT_LEN;
+
+/// Maximum number of bytes which may be derived from each output
+const MAX_HKDF_LENGTH: usize = 256;
+
+/// Maximum number of epochs reported by the epoch span endpoint
+const MAX_EPOCH_SPAN: usize = 1024;
+
+/// Furthest past the current time which schedule lookups may reach
+const MAX_SCHEDULE_LOOKAHEAD: time::Duration = time::Duration::days(366);
+
+/// Maximum length in bytes of a point's correlation token
+const MAX_TOKEN_LENGTH: usize = 256;
+
+/// Default number of entries in a page of the schedule
+const DEFAULT_SCHEDULE_PAGE: usize = 64;
+
+/// Default duration of a CPU profile, in seconds
+const DEFAULT_PROFILE_SECONDS: u64 = 30;
+
+/// Maximum duration of a CPU profile, in seconds
+const MAX_PROFILE_SECONDS: u64 = 300;
+
+/// Sampling frequency of CPU profiles, in hertz
+const PROFILE_FREQUENCY: i32 = 100;
+
+/// Media type for CBOR-encoded response bodies
+pub const CBOR_MEDIA_TYPE: &str = "application/cbor";
+
+/// Media type for raw binary request and response bodies
+const RAW_MEDIA_TYPE: &str = "application/octet-stream";
+
+/// Methods allowed in cross-origin requests
+const CORS_ALLOW_METHODS: &str = "GET, POST, OPTIONS";
+
+/// Request headers allowed in cross-origin requests
+const CORS_ALLOW_HEADERS: &str = "Accept, Authorization, Content-Encoding, Content-Type";
+
+/// Response headers readable by cross-origin clients
+const CORS_EXPOSE_HEADERS: &str = "Retry-After";
+
+/// Domain separator for public key commitments
+pub const KEY_COMMITMENT_DOMAIN: &[u8] = b"star-randsrv key commitment";
+
+/// Domain separator for deriving shuffle seeds
+pub const SHUFFLE_SEED_DOMAIN: &[u8] = b"star-randsrv shuffle seed";
+
+/// Length of a base64-encoded compressed point, including padding
+const ENCODED_POINT_LEN: usize = (ppoprf::COMPRESSED_POINT_LEN + 2) / 3 * 4;
+
+/// Length of a base64-encoded compressed point without padding
+const UNPADDED_POINT_LEN: usize = (ppoprf::COMPRESSED_POINT_LEN * 4 + 2) / 3;
+
+/// Base64 variants accepted for input points if the standard one
+/// fails, for clients which encode points for use in URLs
+const ALTERNATE_ENCODINGS: [&GeneralPurpose; 3] = [
+    &BASE64_URL_SAFE,
+    &BASE64_STANDARD_NO_PAD,
+    &BASE64_URL_SAFE_NO_PAD,
+];
+
+/// Declare the randomness request structure, along with a variant
+/// rejecting unknown fields for `--strict-json`
+///
+/// Serde can only reject unknown fields by attribute, and collecting
+/// them with `flatten` instead buffers the whole request, so both
+/// variants are generated from the same field list.
+macro_rules! randomness_request {
+    ($($(#[$attr:meta])* $field:ident: $type:ty,)*) => {
+        /// Request structure for the randomness endpoint
+        #[derive(Deserialize, Debug)]
+        pub struct RandomnessRequest {
+            $($(#[$attr])* $field: $type,)*
+        }
+
+        /// Randomness request which fails to decode if it has
+        /// unknown fields
+        #[derive(Deserialize, Debug)]
+        #[serde(deny_unknown_fields)]
+        pub struct StrictRandomnessRequest {
+            $($(#[$attr])* $field: $type,)*
+        }
+
+        impl From<StrictRandomnessRequest> for RandomnessRequest {
+            fn from(request: StrictRandomnessRequest) -> Self {
+                RandomnessRequest {
+                    $($field: request.$field,)*
+                }
+            }
+        }
+    };
+}
+
+randomness_request! {
     /// Array of points to evaluate
-    /// Should be base64-encoded, compressed Ristretto curve points.
-    points: Vec<String>,
+    /// Should be base64-encoded, compressed Ristretto curve points,
+    /// optionally tagged with an identifier.
+    points: Vec<PointEntry>,
     /// Optional request for evaluation within a specific epoch
     epoch: Option<u8>,
+    /// Optional request to expand each output with HKDF
+    hkdf: Option<HkdfParams>,
+    /// Whether to annotate the response with the epoch's
+    /// start time and the time of the next epoch
+    #[serde(default)]
+    include_epoch_times: bool,
+    /// Whether to return only the number of points which could
+    /// be evaluated, rather than the outputs
+    #[serde(default)]
+    count_only: bool,
+    /// Whether to return a seed for shuffling the batch,
+    /// derived from the epoch and inputs
+    #[serde(default)]
+    include_shuffle_seed: bool,
+    /// Whether to reject the request if any point is repeated
+    #[serde(default)]
+    require_distinct: bool,
+    /// Whether to return a commitment to the public key used
+    #[serde(default)]
+    include_key_commitment: bool,
+    /// Whether to return the public key used
+    #[serde(default)]
+    include_public_key: bool,
+    /// Whether to return a proof with each output that it was
+    /// evaluated with the published public key
+    #[serde(default)]
+    verifiable: bool,
+    /// Request indices of the points to return proofs for, when
+    /// `verifiable` is set
+    /// The other points are evaluated without proofs. Defaults to
+    /// every point.
+    proof_indices: Option<Vec<usize>>,
+    /// Whether to also return each output evaluated without a
+    /// proof, with `verifiable`, so clients can compare the two
+    #[serde(default)]
+    both: bool,
+    /// Encoding of the request and response points
+    #[serde(default)]
+    encoding: PointEncoding,
+    /// Whether to evaluate the valid points and report errors for
+    /// the others, rather than failing the whole request
+    #[serde(default)]
+    partial: bool,
+}
+
+/// Batch of randomness requests which fails to decode if any has
+/// unknown fields
+#[derive(Deserialize, Debug)]
+#[serde(transparent)]
+pub struct StrictRandomnessBatch(Vec<StrictRandomnessRequest>);
+
+impl From<StrictRandomnessBatch> for Vec<RandomnessRequest> {
+    fn from(batch: StrictRandomnessBatch) -> Self {
+        batch.0.into_iter().map(Into::into).collect()
+    }
+}
+
+impl RandomnessRequest {
+    /// Number of points the request asks to prove
+    fn proof_count(&self) -> usize {
+        match (&self.proof_indices, self.verifiable) {
+            (_, false) => 0,
+            (Some(indices), true) => indices.iter().collect::<HashSet<_>>().len(),
+            (None, true) => self.points.len(),
+        }
+    }
+}
+
+/// Point within a randomness request or response
+///
+/// Points may be given bare, or as an object carrying an opaque
+/// client identifier and correlation token, which are echoed back
+/// with the output for that point. Neither is used in evaluation.
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(untagged)]
+pub enum PointEntry {
+    /// Base64-encoded point
+    Bare(String),
+    /// Base64-encoded point with client metadata
+    Identified {
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        id: Option<String>,
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        token: Option<String>,
+        point: String,
+    },
+}
+
+impl PointEntry {
+    /// The base64-encoded point
+    fn point(&self) -> &str {
+        match self {
+            PointEntry::Bare(point) => point,
+            PointEntry::Identified { point, .. } => point,
+        }
+    }
+
+    /// The correlation token, if any
+    fn token(&self) -> Option<&str> {
+        match self {
+            PointEntry::Bare(_) => None,
+            PointEntry::Identified { token, .. } => token.as_deref(),
+        }
+    }
+
+    /// Replace the point, keeping any identifier and token
+    fn with_point(self, point: String) -> Self {
+        match self {
+            PointEntry::Bare(_) => PointEntry::Bare(point),
+            PointEntry::Identified { id, token, .. } => {
+                PointEntry::Identified { id, token, point }
+            }
+        }
+    }
+}
+
+/// Text encoding of the points in a randomness request and response
+#[derive(Deserialize, Debug, Default, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum PointEncoding {
+    /// Base64, standard in responses, but also URL-safe or
+    /// unpadded in requests
+    #[default]
+    Base64,
+    /// Hexadecimal, lowercase in responses
+    Hex,
+}
+
+impl PointEncoding {
+    /// Whether a string has the length of an encoded point
+    fn is_point_length(self, encoded: &str) -> bool {
+        match self {
+            PointEncoding::Base64 => {
+                encoded.len() == ENCODED_POINT_LEN || encoded.len() == UNPADDED_POINT_LEN
+            }
+            PointEncoding::Hex => encoded.len() == ppoprf::COMPRESSED_POINT_LEN * 2,
+        }
+    }
+
+    /// Decode a single point
+    fn decode(self, encoded: &str) -> Result<ppoprf::Point> {
+        match self {
+            PointEncoding::Base64 => decode_point(encoded),
+            PointEncoding::Hex => {
+                if !self.is_point_length(encoded) {
+                    return Err(Error::BadPoint);
+                }
+                let input = decode_hex(encoded).ok_or(Error::BadPoint)?;
+                point_from_bytes(&input)
+            }
+        }
+    }
+
+    /// Decode bytes other than a point, such as a proof
+    fn decode_bytes(self, encoded: &str) -> Result<Vec<u8>> {
+        match self {
+            PointEncoding::Base64 => Ok(BASE64.decode(encoded)?),
+            PointEncoding::Hex => decode_hex(encoded).ok_or(Error::Hex),
+        }
+    }
+
+    /// Encode output bytes
+    fn encode(self, bytes: &[u8]) -> String {
+        match self {
+            PointEncoding::Base64 => BASE64.encode(bytes),
+            PointEncoding::Hex => bytes.iter().map(|byte| format!("{byte:02x}")).collect(),
+        }
+    }
+
+    /// Map an encoded point to a single representative encoding
+    /// Decoding is canonical in both encodings, so distinct points
+    /// have distinct representatives.
+    fn canonical(self, encoded: &str) -> String {
+        match self {
+            PointEncoding::Base64 => encoded
+                .trim_end_matches('=')
+                .replace('-', "+")
+                .replace('_', "/"),
+            PointEncoding::Hex => encoded.to_ascii_lowercase(),
+        }
+    }
+}
+
+/// Decode a hexadecimal string of either case
+fn decode_hex(encoded: &str) -> Option<Vec<u8>> {
+    if encoded.len() % 2 != 0 || !encoded.bytes().all(|c| c.is_ascii_hexdigit()) {
+        return None;
+    }
+    (0..encoded.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(&encoded[i..i + 2], 16).ok())
+        .collect()
+}
+
+/// Parameters for deriving output bytes with HKDF-SHA256
+///
+/// When present, each compressed output point is used as the
+/// input keying material, and the expanded bytes are returned
+/// in place of the point.
+#[derive(Deserialize, Debug)]
+pub struct HkdfParams {
+    /// Base64-encoded HKDF salt
+    salt: String,
+    /// Base64-encoded HKDF context info, empty if omitted
+    #[serde(default)]
+    info: String,
+    /// Number of bytes to derive from each output
+    length: usize,
 }
 
 /// Response structure for the randomness endpoint
@@ -26,10 +362,97 @@ pub struct RandomnessRequest {
 pub struct RandomnessResponse {
     /// Resulting points from the OPRF valuation
     /// Should be base64-encoded, compressed points in one-to-one
-    /// correspondence with the request points array.
-    points: Vec<String>,
+    /// correspondence with the request points array, tagged
+    /// with the same identifiers as the request points.
+    /// Omitted for count-only requests.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    points: Option<Vec<PointEntry>>,
+    /// Request indices of the returned points, in one-to-one
+    /// correspondence with `points`
+    /// Only present for partial requests.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    indices: Option<Vec<usize>>,
+    /// Errors for the request points which couldn't be evaluated
+    /// Only present for partial requests.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    errors: Option<Vec<ErrorResponse>>,
+    /// Encoded proofs of correct evaluation, in one-to-one
+    /// correspondence with `points`, or with `proof_indices` if
+    /// the request selected the points to prove
+    /// Only present for verifiable requests.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    proofs: Option<Vec<String>>,
+    /// Request indices of the points with proofs, in one-to-one
+    /// correspondence with `proofs`
+    /// Only present if the request selected the points to prove.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    proof_indices: Option<Vec<usize>>,
+    /// Outputs evaluated without proofs, in one-to-one
+    /// correspondence with `points`
+    /// Only present if the request asked for both outputs.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    unproven_points: Option<Vec<PointEntry>>,
+    /// Number of request points successfully evaluated
+    /// Only present for count-only requests.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    count: Option<usize>,
     /// Randomness epoch used in the evaluation
     epoch: u8,
+    /// Timestamp at which the evaluation epoch began, if requested
+    /// This should be a string in RFC 3339 format.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    epoch_start_time: Option<String>,
+    /// Timestamp at which the next epoch begins, if requested
+    #[serde(skip_serializing_if = "Option::is_none")]
+    next_epoch_time: Option<String>,
+    /// Encoded seed for shuffling the batch, if requested
+    /// See `shuffle_seed` for the derivation.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    shuffle_seed: Option<String>,
+    /// Encoded commitment to the public key, if requested
+    /// See `key_commitment` for the construction.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    key_commitment: Option<String>,
+    /// Base64-encoded public key the outputs were evaluated with,
+    /// if requested
+    /// Every epoch is evaluated with the current key, so this matches
+    /// the `publicKey` reported by the info endpoint at the time.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    public_key: Option<String>,
+}
+
+impl RandomnessResponse {
+    /// Number of points evaluated for the response
+    fn evaluated(&self) -> usize {
+        match &self.points {
+            Some(points) => points.len(),
+            None => self.count.unwrap_or(0),
+        }
+    }
+}
+
+/// Result of one request within a multi-request batch
+/// Each entry is either a successful evaluation or an error,
+/// so one failed request doesn't affect the others.
+#[derive(Serialize, Debug)]
+#[serde(untagged)]
+pub enum MultiRandomnessResult {
+    Ok(RandomnessResponse),
+    Err(ErrorResponse),
+}
+
+/// Public key in effect from a given epoch, reported by the
+/// info endpoint
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct KeyHistoryEntry {
+    /// Number of keys the instance generated before this one,
+    /// identifying it to the verify endpoint
+    generation: u64,
+    /// Epoch in which the key took effect
+    epoch: u8,
+    /// Base64-encoded ServerPublicKey
+    public_key: String,
 }
 
 /// Response structure for the info endpoint
@@ -39,14 +462,209 @@ pub struct RandomnessResponse {
 pub struct InfoResponse {
     /// ServerPublicKey used to verify zero-knowledge proof
     public_key: String,
+    /// ServerPublicKey to be used in the next epoch
+    /// This is the same as `public_key` unless the key changes
+    /// before the next epoch begins. Briefly absent while a new
+    /// key is generated after a rotation.
+    next_public_key: Option<String>,
+    /// Hex-encoded SHA-256 digest of the serialized public key,
+    /// identifying it without comparing the whole key
+    public_key_fingerprint: String,
     /// Currently active randomness epoch
     current_epoch: u8,
+    /// Number of epochs after the current one before the
+    /// key is rotated, resetting all outputs
+    remaining_epochs: u8,
     /// Timestamp of the next epoch rotation
     /// This should be a string in RFC 3339 format,
     /// e.g. 2023-03-14T16:33:05Z.
     next_epoch_time: Option<String>,
+    /// Whole seconds remaining until the next epoch rotation
+    seconds_until_next_epoch: Option<i64>,
+    /// Length of the current epoch in whole seconds
+    epoch_len_seconds: Option<i64>,
+    /// Timestamp of the next scheduled key rotation
+    /// Only present if periodic key rotation is configured.
+    /// Same format as `next_epoch_time`.
+    next_key_rotation_time: Option<String>,
+    /// Recent public keys, oldest first, ending with the current one
+    key_history: Vec<KeyHistoryEntry>,
     /// Maximum number of points accepted in a single request
     max_points: usize,
+    /// Maximum number of points proved in a single request
+    max_verifiable_points: usize,
+    /// Maximum size of a request body accepted, in bytes
+    max_request_bytes: usize,
+    /// Whether the server can return proofs with its evaluations
+    proofs_supported: bool,
+    /// Group in which points are evaluated
+    curve: &'static str,
+    /// Hash function used to map inputs to points
+    hash: &'static str,
+    /// Length of each output before encoding, in bytes
+    /// Requests expanding outputs with HKDF choose their own length.
+    output_length: usize,
+    /// Delay of this server's epoch boundaries from the
+    /// configured schedule, in milliseconds
+    epoch_offset_ms: u64,
+    /// Recent evaluation latency
+    /// Only present if enabled with `--expose-latency`, once
+    /// requests have been evaluated.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    latency: Option<Latency>,
+}
+
+/// Percentiles of recent evaluation latency, in microseconds
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct Latency {
+    /// Number of evaluations the percentiles are taken over
+    samples: usize,
+    p50_micros: u64,
+    p95_micros: u64,
+    p99_micros: u64,
+}
+
+/// Response structure for the status endpoint
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct StatusResponse {
+    /// Currently active randomness epoch
+    current_epoch: u8,
+    /// Number of epochs after the current one before the
+    /// key is rotated
+    remaining_epochs: u8,
+    /// Timestamp at which the public key next changes, either
+    /// from exhausting the epochs or periodic key rotation
+    /// Only present once the epoch schedule is running.
+    next_key_change_time: Option<String>,
+    /// Whole seconds remaining until the public key changes
+    seconds_until_key_change: Option<i64>,
+    /// Whether randomness serving has been paused by an operator
+    paused: bool,
+    /// Number of outputs held in the evaluation cache
+    /// Only present if caching is enabled with `--eval-cache-size`.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    eval_cache_entries: Option<usize>,
+}
+
+/// Request structure for the verify endpoint
+#[derive(Deserialize, Debug)]
+pub struct VerifyRequest {
+    /// Base64-encoded point submitted for evaluation
+    input: String,
+    /// Base64-encoded point returned for `input`
+    output: String,
+    /// Base64-encoded proof returned with `output`
+    proof: String,
+    /// Epoch the output was evaluated in
+    epoch: u8,
+    /// Base64-encoded public key, as published by the info endpoint
+    /// Exactly one of this and `generation` must be given.
+    public_key: Option<String>,
+    /// Generation of a key in the instance's key history, as
+    /// listed by the info endpoint, to verify with instead
+    generation: Option<u64>,
+    /// Encoding of the points and proof, as chosen in the randomness
+    /// request which returned them
+    /// The public key is always base64-encoded.
+    #[serde(default)]
+    encoding: PointEncoding,
+}
+
+/// Response structure for the verify endpoint
+#[derive(Serialize, Debug)]
+pub struct VerifyResponse {
+    /// Whether the proof shows `output` was correctly evaluated
+    valid: bool,
+}
+
+/// Query parameters for the info endpoint
+#[derive(Deserialize, Debug)]
+pub struct InfoQuery {
+    /// Time at which to report the epoch, in RFC 3339 format,
+    /// instead of the current time
+    ///
+    /// Only the epoch fields follow this time. The public keys
+    /// reported are always the current ones, since future keys
+    /// don't exist yet.
+    at: Option<String>,
+}
+
+/// Query parameters for the epoch span endpoint
+#[derive(Deserialize, Debug)]
+pub struct EpochSpanQuery {
+    /// Start of the time range, in RFC 3339 format
+    from: String,
+    /// End of the time range, in RFC 3339 format
+    to: String,
+}
+
+/// Response structure for the epoch span endpoint
+#[derive(Serialize, Debug)]
+pub struct EpochSpanResponse {
+    /// Number of epochs overlapping the time range
+    /// Each of these produces distinct outputs for the same input.
+    count: usize,
+    /// Epoch tags in effect over the time range, in order
+    epochs: Vec<u8>,
+}
+
+/// Query parameters for the schedule endpoint
+#[derive(Deserialize, Debug)]
+pub struct ScheduleQuery {
+    /// Index of the first entry to return
+    #[serde(default)]
+    offset: usize,
+    /// Number of entries to return, capped at `--max-schedule-entries`
+    limit: Option<usize>,
+}
+
+/// State of an epoch within the current key's schedule
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "lowercase")]
+pub enum EpochStatus {
+    Punctured,
+    Current,
+    Upcoming,
+}
+
+/// Entry in the schedule listing
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct ScheduleEntry {
+    /// Epoch tag
+    epoch: u8,
+    /// Whether the epoch is past, present or future
+    status: EpochStatus,
+    /// Timestamp at which an upcoming epoch begins
+    /// Only present once the epoch schedule is running.
+    start_time: Option<String>,
+}
+
+/// Response structure for the schedule endpoint
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct ScheduleResponse {
+    /// Page of epochs for the current key, in order
+    epochs: Vec<ScheduleEntry>,
+    /// Total number of epochs for the current key
+    total: usize,
+    /// Offset of the next page, if there is one
+    next_offset: Option<usize>,
+    /// Whether fewer entries were returned than requested
+    /// because of the server's limit on page size
+    truncated: bool,
+}
+
+/// Response structure for the health endpoint
+#[derive(Serialize, Debug)]
+pub struct HealthResponse {
+    /// `ok` if every instance can evaluate, otherwise `unavailable`
+    status: &'static str,
+    /// Why the server is unhealthy, if it is
+    #[serde(skip_serializing_if = "Option::is_none")]
+    reason: Option<String>,
 }
 
 /// Response structure for the "list instances" endpoint.
@@ -60,11 +678,62 @@ pub struct ListInstancesResponse {
     default_instance: String,
 }
 
+/// Response structure for the version endpoint
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct VersionResponse {
+    /// Version of this server
+    version: &'static str,
+    /// Source revision the server was built from, if known
+    git_commit: Option<&'static str>,
+    /// Time the server was built, if given by the builder
+    build_time: Option<&'static str>,
+    /// Version of the compiler which built the server
+    rustc_version: &'static str,
+    /// Version of the PPOPRF library linked into the server
+    ppoprf_version: &'static str,
+}
+
+/// Request structure for the CPU profile endpoint
+#[derive(Deserialize, Debug)]
+pub struct ProfileQuery {
+    /// Number of seconds to sample for
+    seconds: Option<u64>,
+}
+
+/// Response structure for the heap statistics endpoint
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct HeapResponse {
+    /// Bytes allocated by the server
+    allocated_bytes: usize,
+    /// Bytes in pages holding allocations
+    active_bytes: usize,
+    /// Bytes of physical memory held by the allocator
+    resident_bytes: usize,
+    /// Bytes in chunks mapped by the allocator
+    mapped_bytes: usize,
+    /// Bytes of virtual memory retained for reuse
+    retained_bytes: usize,
+}
+
 /// Response returned to report error conditions
 #[derive(Serialize, Debug)]
-struct ErrorResponse {
+pub struct ErrorResponse {
     /// Human-readable description of the error
     message: String,
+    /// Index of the request point which caused the error, if any
+    #[serde(skip_serializing_if = "Option::is_none")]
+    index: Option<usize>,
+}
+
+impl From<Error> for ErrorResponse {
+    fn from(error: Error) -> Self {
+        ErrorResponse {
+            index: error.index(),
+            message: error.to_string(),
+        }
+    }
 }
 
 /// Server error conditions
@@ -79,14 +748,101 @@ pub enum Error {
     LockFailure,
     #[error("Invalid point")]
     BadPoint,
-    #[error("Too many points for a single request")]
-    TooManyPoints,
+    #[error("input point is the identity element")]
+    IdentityPoint,
+    #[error("{source}")]
+    PointError { index: usize, source: Box<Error> },
+    #[error("{0}")]
+    StrictJson(String),
+    #[error("Too many points for a single request: the limit is {0}")]
+    TooManyPoints(usize),
     #[error("Invalid epoch {0}`")]
     BadEpoch(u8),
+    #[error("epoch {0} has been punctured")]
+    PuncturedEpoch(u8),
+    #[error("Point {0} duplicates an earlier point")]
+    DuplicatePoint(usize),
+    #[error("Proofs can't be returned for HKDF output")]
+    ProofWithHkdf,
+    #[error("Proofs can't be returned when only counting points")]
+    ProofWithCount,
+    #[error("Exactly one of public_key and generation is required")]
+    VerifyKeyChoice,
+    #[error("Key generation {0} is not retained")]
+    KeyGenerationUnavailable(u64),
+    #[error("Too many proofs for a single request: the limit is {0}")]
+    TooManyProofs(usize),
+    #[error("Both outputs require a verifiable request")]
+    BothWithoutProofs,
+    #[error("Proof indices require a verifiable request")]
+    ProofIndicesWithoutProofs,
+    #[error("Proof index {0} is out of range")]
+    BadProofIndex(usize),
+    #[error("Evaluation proof missing for point {0}")]
+    ProofMissing(usize),
+    #[error("Correlation token too long: {0} bytes")]
+    TokenTooLong(usize),
+    #[error("Invalid HKDF output length {0}")]
+    BadHkdfLength(usize),
+    #[error("Invalid timestamp '{0}'")]
+    BadTimestamp(String),
+    #[error("Invalid time range")]
+    BadTimeRange,
+    #[error("Timestamp is before the first epoch")]
+    TimestampBeforeBase,
+    #[error("Timestamp is too far in the future")]
+    TimestampTooLate,
+    #[error("Invalid page limit {0}")]
+    BadPageLimit(usize),
+    #[error("Epoch schedule not yet available")]
+    ScheduleUnavailable,
+    #[error("Timed out decoding points")]
+    ParseTimeout,
+    #[error("Timed out evaluating points")]
+    EvalTimeout,
+    #[error("Too many concurrent requests")]
+    Overloaded,
+    #[error("Rate limit exceeded, retry in {0} seconds")]
+    RateLimited(u64),
+    #[error("Epoch rotation has stalled")]
+    StaleEpoch,
+    #[error("Couldn't encode response: {0}")]
+    Encoding(String),
+    #[error("Randomness serving is paused")]
+    Paused,
+    #[error("Missing or invalid bearer token")]
+    Unauthorized,
+    // Keep the detailed messages of axum's own extractors.
+    #[error("{}", .0.body_text())]
+    JsonBody(#[from] JsonRejection),
+    #[error("{}", .0.body_text())]
+    Body(#[from] BytesRejection),
+    #[error("{}", .0.body_text())]
+    Query(#[from] QueryRejection),
+    #[error("Invalid CBOR request: {0}")]
+    Cbor(String),
     #[error("Invalid base64 encoding: {0}")]
     Base64(#[from] base64::DecodeError),
+    #[error("Invalid hex encoding")]
+    Hex,
     #[error("PPOPRF error: {0}")]
     Oprf(#[from] ppoprf::PPRFError),
+    #[error("Couldn't serialize key material: {0}")]
+    Serialization(ppoprf::PPRFError),
+    #[error("Internal server error")]
+    Panic,
+    #[error("Invalid profile duration {0}")]
+    BadProfileDuration(u64),
+    #[error("Profiling failed: {0}")]
+    Profiler(#[from] pprof::Error),
+    #[error("Couldn't read allocator statistics: {0}")]
+    Allocator(#[from] tikv_jemalloc_ctl::Error),
+    #[error("Evaluation failed for point {index} in epoch {epoch}: {source}")]
+    EvalFailed {
+        epoch: u8,
+        index: usize,
+        source: ppoprf::PPRFError,
+    },
 }
 
 /// thiserror doesn't generate a `From` impl without
@@ -101,24 +857,91 @@ impl<T> From<std::sync::PoisonError<T>> for Error {
     }
 }
 
-impl axum::response::IntoResponse for Error {
-    /// Construct an http response from our error type
-    fn into_response(self) -> axum::response::Response {
-        let code = match self {
+impl Error {
+    /// Seconds after which a client may retry, for transient errors
+    fn retry_after(&self) -> Option<u64> {
+        match self {
+            Error::ParseTimeout | Error::EvalTimeout | Error::Overloaded => Some(1),
+            Error::RateLimited(seconds) => Some(*seconds),
+            _ => None,
+        }
+    }
+
+    /// HTTP status code reporting the error
+    fn status(&self) -> StatusCode {
+        match self {
+            // Keep the status codes of axum's own extractors.
+            Error::JsonBody(rejection) => rejection.status(),
+            Error::Body(rejection) => rejection.status(),
+            Error::Query(rejection) => rejection.status(),
+            Error::PointError { source, .. } => source.status(),
             Error::InstanceNotFound(_) => StatusCode::NOT_FOUND,
-            // This indicates internal failure.
-            Error::LockFailure => StatusCode::INTERNAL_SERVER_ERROR,
+            Error::Unauthorized => StatusCode::UNAUTHORIZED,
+            Error::RateLimited(_) => StatusCode::TOO_MANY_REQUESTS,
+            Error::DuplicatePoint(_) => StatusCode::UNPROCESSABLE_ENTITY,
+            // Punctured epochs can never be evaluated again, nor
+            // discarded keys recovered.
+            Error::PuncturedEpoch(_) | Error::KeyGenerationUnavailable(_) => StatusCode::GONE,
+            // These indicate internal failure.
+            Error::LockFailure
+            | Error::EvalFailed { .. }
+            | Error::ProofMissing(_)
+            | Error::Encoding(_)
+            | Error::Serialization(_)
+            | Error::Profiler(_)
+            | Error::Allocator(_)
+            | Error::Panic => {
+                StatusCode::INTERNAL_SERVER_ERROR
+            }
+            Error::ScheduleUnavailable
+            | Error::ParseTimeout
+            | Error::EvalTimeout
+            | Error::Overloaded
+            | Error::StaleEpoch
+            | Error::Paused => {
+                StatusCode::SERVICE_UNAVAILABLE
+            }
             // Other cases are the client's fault.
             _ => StatusCode::BAD_REQUEST,
-        };
-        let body = Json(ErrorResponse {
-            message: self.to_string(),
-        });
-        (code, body).into_response()
+        }
+    }
+
+    /// Index of the request point which caused the error, if any
+    fn index(&self) -> Option<usize> {
+        match self {
+            Error::PointError { index, .. }
+            | Error::EvalFailed { index, .. }
+            | Error::DuplicatePoint(index) => Some(*index),
+            _ => None,
+        }
+    }
+
+    /// Attribute an error to the request point at `index`
+    fn at_point(self, index: usize) -> Self {
+        Error::PointError {
+            index,
+            source: Box::new(self),
+        }
     }
 }
 
-type Result<T> = std::result::Result<T, Error>;
+impl axum::response::IntoResponse for Error {
+    /// Construct an http response from our error type
+    fn into_response(self) -> axum::response::Response {
+        let code = self.status();
+        let retry_after = self.retry_after();
+        let body = Json(ErrorResponse::from(self));
+        let mut response = (code, body).into_response();
+        if let Some(seconds) = retry_after {
+            response
+                .headers_mut()
+                .insert(header::RETRY_AFTER, HeaderValue::from(seconds));
+        }
+        response
+    }
+}
+
+type Result<T, E = Error> = std::result::Result<T, E>;
 
 fn get_server_from_state<'a>(
     state: &'a OPRFState,
@@ -131,46 +954,816 @@ fn get_server_from_state<'a>(
         .read()?)
 }
 
-/// Process PPOPRF evaluation requests
-#[instrument(skip(state, request))]
-async fn randomness(
-    state: OPRFState,
-    instance_name: String,
+/// Whether a media type, possibly with parameters, is CBOR
+fn is_cbor(media_type: &str) -> bool {
+    media_type
+        .split(';')
+        .next()
+        .is_some_and(|essence| essence.trim().eq_ignore_ascii_case(CBOR_MEDIA_TYPE))
+}
+
+/// Decode a request body in the format given by its `Content-Type`
+/// Bodies are decoded as CBOR if labeled as such, and otherwise
+/// as JSON, with the same checks as axum's `Json` extractor.
+async fn decode_body<T: DeserializeOwned>(request: Request) -> Result<T> {
+    let cbor = request
+        .headers()
+        .get(header::CONTENT_TYPE)
+        .and_then(|value| value.to_str().ok())
+        .is_some_and(is_cbor);
+    if cbor {
+        let body = Bytes::from_request(request, &()).await?;
+        return ciborium::from_reader(body.as_ref()).map_err(|e| Error::Cbor(e.to_string()));
+    }
+    let Json(value) = Json::<T>::from_request(request, &()).await?;
+    Ok(value)
+}
+
+/// Decode randomness requests, using the strict variant `S` of
+/// the request type `T` when configured to reject unknown fields
+async fn decode_randomness<T, S>(server: &OPRFServer, request: Request) -> Result<T>
+where
+    T: DeserializeOwned,
+    S: DeserializeOwned + Into<T>,
+{
+    if server.strict_json {
+        // axum answers data errors with 422, but an unknown field is
+        // a malformed request like any other. Serde reports it only
+        // in the message, so other data errors, such as a field of
+        // the wrong type, are left as they are.
+        return match decode_body::<S>(request).await {
+            Err(Error::JsonBody(JsonRejection::JsonDataError(e)))
+                if e.body_text().contains("unknown field") =>
+            {
+                Err(Error::StrictJson(e.body_text()))
+            }
+            result => result.map(Into::into),
+        };
+    }
+    decode_body(request).await
+}
+
+/// Encode a response body in the format requested by the client
+/// Bodies are CBOR-encoded if the `Accept` header lists CBOR,
+/// and JSON-encoded otherwise.
+fn negotiate<T: Serialize>(headers: &HeaderMap, body: T) -> Result<Response> {
+    let accepts_cbor = headers
+        .get_all(header::ACCEPT)
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|value| value.split(','))
+        .any(is_cbor);
+    if !accepts_cbor {
+        return Ok(Json(body).into_response());
+    }
+    let mut bytes = Vec::new();
+    ciborium::into_writer(&body, &mut bytes).map_err(|e| Error::Encoding(e.to_string()))?;
+    Ok(([(header::CONTENT_TYPE, CBOR_MEDIA_TYPE)], bytes).into_response())
+}
+
+/// Record metrics for a successful evaluation since `start`
+/// Metrics are only exported with `--prometheus-listen`, while
+/// the latency window for /info is kept if `--expose-latency` is set.
+fn record_evaluation(
+    server: &OPRFServer,
+    instance_name: &str,
+    epoch: u8,
+    points: usize,
+    start: Instant,
+) {
+    let elapsed = start.elapsed();
+    debug!(
+        instance_name,
+        epoch,
+        points,
+        latency_ms = elapsed.as_millis() as u64,
+        "evaluated"
+    );
+    let instance = instance_name.to_string();
+    counter!(
+        "randomness_points_total",
+        "instance" => instance.clone(),
+        "epoch" => epoch.to_string()
+    )
+    .increment(points as u64);
+    histogram!("randomness_evaluation_seconds", "instance" => instance)
+        .record(elapsed.as_secs_f64());
+    // A panic while recording leaves nothing worse than a stray
+    // sample, so don't fail requests over a poisoned window.
+    if let Some(latency) = &server.latency {
+        latency
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .record(elapsed);
+    }
+}
+
+/// Refuse to evaluate if serving is paused, or if configured to
+/// fail closed and the epoch rotation task has stalled
+fn check_fresh(server: &OPRFServer, state: &OPRFInstance) -> Result<()> {
+    if server.paused.load(Ordering::Relaxed) {
+        return Err(Error::Paused);
+    }
+    let now = server.now();
+    match server.stale_loop_bound {
+        Some(bound) if state.is_stale(bound, now) => Err(Error::StaleEpoch),
+        _ => Ok(()),
+    }
+}
+
+/// Time limits on handling a request, from when it arrived
+#[derive(Clone, Copy, Debug, Default)]
+struct Deadlines {
+    /// Time by which its points must be decoded
+    parse: Option<Instant>,
+    /// Time by which its points must be evaluated
+    eval: Option<Instant>,
+}
+
+impl Deadlines {
+    /// Start the clock on a request
+    fn start(server: &OPRFServer) -> Self {
+        let now = Instant::now();
+        Deadlines {
+            parse: server.max_parse_time.map(|limit| now + limit),
+            eval: server.eval_timeout.map(|limit| now + limit),
+        }
+    }
+
+    /// Fail if the time allowed for evaluating points has passed
+    fn check_eval(&self) -> Result<()> {
+        if self.eval.is_some_and(|deadline| Instant::now() >= deadline) {
+            return Err(Error::EvalTimeout);
+        }
+        Ok(())
+    }
+}
+
+/// Fail if the time allowed for decoding points has passed
+fn check_deadline(deadline: Option<Instant>) -> Result<()> {
+    if deadline.is_some_and(|deadline| Instant::now() >= deadline) {
+        return Err(Error::ParseTimeout);
+    }
+    Ok(())
+}
+
+/// Decode a single base64-encoded point
+/// Standard base64 is expected, but URL-safe and unpadded
+/// encodings are also accepted.
+fn decode_point(encoded: &str) -> Result<ppoprf::Point> {
+    if !PointEncoding::Base64.is_point_length(encoded) {
+        return Err(Error::BadPoint);
+    }
+    let input = BASE64.decode(encoded).or_else(|error| {
+        ALTERNATE_ENCODINGS
+            .iter()
+            .find_map(|engine| engine.decode(encoded).ok())
+            .ok_or(error)
+    })?;
+    point_from_bytes(&input)
+}
+
+/// Construct a point from its compressed encoding
+/// The identity element is rejected, since it's a degenerate input
+/// whose output reveals nothing but can probe the server.
+fn point_from_bytes(input: &[u8]) -> Result<ppoprf::Point> {
+    // FIXME: Point::from is fallible and needs to return a result.
+    // partial work-around: check correct length
+    if input.len() != ppoprf::COMPRESSED_POINT_LEN {
+        return Err(Error::BadPoint);
+    }
+    // The identity is the only point encoded as all zeros.
+    if input.iter().all(|&byte| byte == 0) {
+        return Err(Error::IdentityPoint);
+    }
+    Ok(ppoprf::Point::from(input))
+}
+
+/// Decode the points of a request, giving up after `deadline`
+///
+/// Every point is checked for the expected encoded length before
+/// any is decoded, so malformed requests are rejected cheaply.
+fn decode_points(
+    entries: &[PointEntry],
+    encoding: PointEncoding,
+    deadline: Option<Instant>,
+) -> Result<Vec<ppoprf::Point>> {
+    if let Some(index) = entries.iter().position(|e| !encoding.is_point_length(e.point())) {
+        return Err(Error::BadPoint.at_point(index));
+    }
+    let mut points = Vec::with_capacity(entries.len());
+    for (index, entry) in entries.iter().enumerate() {
+        check_deadline(deadline)?;
+        points.push(encoding.decode(entry.point()).map_err(|e| e.at_point(index))?);
+    }
+    Ok(points)
+}
+
+/// Decode the points of a request, reporting those which fail
+/// Each point which can't be decoded is returned as `None`, with
+/// an error naming its index.
+fn decode_points_partial(
+    entries: &[PointEntry],
+    encoding: PointEncoding,
+    deadline: Option<Instant>,
+) -> Result<(Vec<Option<ppoprf::Point>>, Vec<ErrorResponse>)> {
+    let mut points = Vec::with_capacity(entries.len());
+    let mut errors = Vec::new();
+    for (index, entry) in entries.iter().enumerate() {
+        check_deadline(deadline)?;
+        match encoding.decode(entry.point()) {
+            Ok(point) => points.push(Some(point)),
+            Err(e) => {
+                points.push(None);
+                errors.push(e.at_point(index).into());
+            }
+        }
+    }
+    Ok((points, errors))
+}
+
+/// Derive a seed for shuffling a batch of points
+///
+/// The seed is the SHA-256 digest of the domain separator
+/// `SHUFFLE_SEED_DOMAIN`, followed by the epoch byte, followed by
+/// the 32-byte compressed input points sorted in lexicographic byte
+/// order. Sorting makes it independent of the order of the request,
+/// so anyone holding the inputs can recompute it.
+fn shuffle_seed(epoch: u8, inputs: &[ppoprf::Point]) -> [u8; 32] {
+    let mut sorted: Vec<_> = inputs.iter().map(|point| point.as_bytes()).collect();
+    sorted.sort_unstable();
+    let mut hasher = Sha256::new();
+    hasher.update(SHUFFLE_SEED_DOMAIN);
+    hasher.update([epoch]);
+    for bytes in sorted {
+        hasher.update(bytes);
+    }
+    hasher.finalize().into()
+}
+
+/// Commit to the public key of an instance
+///
+/// The commitment is the SHA-256 digest of the domain separator
+/// `KEY_COMMITMENT_DOMAIN`, followed by the bincode serialization
+/// of the public key, as published base64-encoded by the info
+/// endpoint. It identifies the key which produced an output.
+fn key_commitment(state: &OPRFInstance) -> Result<[u8; 32]> {
+    let public_key = state
+        .server
+        .get_public_key()
+        .serialize_to_bincode()
+        .map_err(Error::Serialization)?;
+    let mut hasher = Sha256::new();
+    hasher.update(KEY_COMMITMENT_DOMAIN);
+    hasher.update(public_key);
+    Ok(hasher.finalize().into())
+}
+
+/// Count the points of a request which can be evaluated
+/// Invalid points are skipped rather than failing the request.
+fn count_valid(
+    state: &OPRFInstance,
+    entries: &[PointEntry],
+    encoding: PointEncoding,
+    epoch: u8,
+    deadlines: Deadlines,
+) -> Result<usize> {
+    let mut count = 0;
+    for entry in entries {
+        check_deadline(deadlines.parse)?;
+        deadlines.check_eval()?;
+        let valid = encoding
+            .decode(entry.point())
+            .ok()
+            .is_some_and(|point| state.server.eval(&point, epoch, false).is_ok());
+        if valid {
+            count += 1;
+        }
+    }
+    Ok(count)
+}
+
+/// Convert a failure evaluating a batch of points, mapping the
+/// index of a failed point within the batch to its request index
+fn eval_error(
+    error: EvalError,
+    epoch: u8,
+    request_index: impl Fn(usize) -> usize,
+) -> Error {
+    match error {
+        EvalError::Failed { index, source } => Error::EvalFailed {
+            epoch,
+            index: request_index(index),
+            source,
+        },
+        EvalError::TimedOut => Error::EvalTimeout,
+    }
+}
+
+/// Bytes of an evaluation output
+/// Outputs are copied into responses as they are, so the return type
+/// ties the length `/info` reports to the PPOPRF's output size at
+/// compile time.
+fn output_bytes(output: &ppoprf::Point) -> &[u8; OUTPUT_LENGTH] {
+    output.as_bytes()
+}
+
+/// Evaluate the points of a single request
+fn evaluate(
+    server: &OPRFServer,
+    state: &OPRFInstance,
     request: RandomnessRequest,
-) -> Result<Json<RandomnessResponse>> {
-    debug!("recv: {request:?}");
-    let state = get_server_from_state(&state, &instance_name)?;
+    deadlines: Deadlines,
+) -> Result<RandomnessResponse> {
+    let max_points = server.max_points;
     let epoch = request.epoch.unwrap_or(state.epoch);
+    if state.punctured.contains(&epoch) {
+        return Err(Error::PuncturedEpoch(epoch));
+    }
     if epoch != state.epoch {
         return Err(Error::BadEpoch(epoch));
     }
-    if request.points.len() > crate::MAX_POINTS {
-        return Err(Error::TooManyPoints);
+    if request.points.len() > max_points {
+        return Err(Error::TooManyPoints(max_points));
+    }
+    if request.require_distinct {
+        let encoding = request.encoding;
+        let canonical = |e: &PointEntry| encoding.canonical(e.point());
+        let mut seen = HashSet::with_capacity(request.points.len());
+        if let Some(index) = request.points.iter().position(|e| !seen.insert(canonical(e))) {
+            return Err(Error::DuplicatePoint(index));
+        }
+    }
+    if let Some(token) = request
+        .points
+        .iter()
+        .filter_map(PointEntry::token)
+        .find(|token| token.len() > MAX_TOKEN_LENGTH)
+    {
+        return Err(Error::TokenTooLong(token.len()));
     }
-    // Don't support returning proofs until we have a more
-    // space-efficient batch proof implemented in ppoprf.
-    let mut points = Vec::with_capacity(request.points.len());
-    for base64_point in request.points {
-        let input = BASE64.decode(base64_point)?;
-        // FIXME: Point::from is fallible and needs to return a result.
-        // partial work-around: check correct length
-        if input.len() != ppoprf::COMPRESSED_POINT_LEN {
-            return Err(Error::BadPoint);
+    // Proofs apply to the output point, which isn't
+    // returned when expanding with HKDF.
+    if request.verifiable && request.hkdf.is_some() {
+        return Err(Error::ProofWithHkdf);
+    }
+    if request.verifiable && request.count_only {
+        return Err(Error::ProofWithCount);
+    }
+    // Which request points to prove, for verifiable requests
+    let mut proved = vec![request.verifiable; request.points.len()];
+    if let Some(proof_indices) = &request.proof_indices {
+        if !request.verifiable {
+            return Err(Error::ProofIndicesWithoutProofs);
+        }
+        proved.fill(false);
+        for &index in proof_indices {
+            *proved.get_mut(index).ok_or(Error::BadProofIndex(index))? = true;
         }
-        let point = ppoprf::Point::from(input.as_slice());
-        let evaluation = state.server.eval(&point, epoch, false)?;
-        points.push(BASE64.encode(evaluation.output.as_bytes()));
     }
-    let response = RandomnessResponse { points, epoch };
+    if request.both && !request.verifiable {
+        return Err(Error::BothWithoutProofs);
+    }
+    let max_proofs = server.max_verifiable_points;
+    if proved.iter().filter(|&&proved| proved).count() > max_proofs {
+        return Err(Error::TooManyProofs(max_proofs));
+    }
+    let hkdf = match request.hkdf {
+        Some(params) => {
+            if params.length == 0 || params.length > MAX_HKDF_LENGTH {
+                return Err(Error::BadHkdfLength(params.length));
+            }
+            let salt = BASE64.decode(params.salt)?;
+            let info = BASE64.decode(params.info)?;
+            Some((salt, info, params.length))
+        }
+        None => None,
+    };
+    let key_commitment = if request.include_key_commitment {
+        Some(request.encoding.encode(&key_commitment(state)?))
+    } else {
+        None
+    };
+    let public_key = if request.include_public_key {
+        let public_key = state.server.get_public_key();
+        Some(BASE64.encode(public_key.serialize_to_bincode().map_err(Error::Serialization)?))
+    } else {
+        None
+    };
+    let (epoch_start_time, next_epoch_time) = if request.include_epoch_times {
+        (state.epoch_start_time.clone(), state.next_epoch_time.clone())
+    } else {
+        (None, None)
+    };
+    if request.count_only {
+        let count = count_valid(state, &request.points, request.encoding, epoch, deadlines)?;
+        return Ok(RandomnessResponse {
+            points: None,
+            indices: None,
+            errors: None,
+            proofs: None,
+            proof_indices: None,
+            unproven_points: None,
+            count: Some(count),
+            epoch,
+            epoch_start_time,
+            next_epoch_time,
+            shuffle_seed: None,
+            key_commitment,
+            public_key,
+        });
+    }
+    let (inputs, errors) = if request.partial {
+        let (inputs, errors) =
+            decode_points_partial(&request.points, request.encoding, deadlines.parse)?;
+        (inputs, Some(errors))
+    } else {
+        let inputs = decode_points(&request.points, request.encoding, deadlines.parse)?;
+        (inputs.into_iter().map(Some).collect(), None)
+    };
+    // Only the valid points are evaluated, keeping their indices
+    // in the request.
+    let mut entries = Vec::with_capacity(request.points.len());
+    let mut indices = Vec::with_capacity(request.points.len());
+    let mut valid = Vec::with_capacity(request.points.len());
+    for (index, (entry, point)) in request.points.into_iter().zip(inputs).enumerate() {
+        if let Some(point) = point {
+            entries.push(entry);
+            indices.push(index);
+            valid.push(point);
+        }
+    }
+    let verifiable = request.verifiable;
+    let proved: Vec<bool> = indices.iter().map(|&index| proved[index]).collect();
+    // With punctured epochs ruled out above, failure here is an
+    // internal error rather than a bad request. Partial requests
+    // report it against the point, like a decoding error, and
+    // others fail on the first one below.
+    let eval_error = |e| eval_error(e, epoch, |index| indices[index]);
+    let evaluations =
+        eval_selected(state, &valid, &proved, epoch, deadlines.eval).map_err(eval_error)?;
+    // Outputs without proofs, for clients comparing the two
+    let mut unproven_evaluations = match request.both {
+        true => Some(
+            state
+                .eval_each(&valid, epoch, false, deadlines.eval)
+                .map_err(eval_error)?
+                .into_iter(),
+        ),
+        false => None,
+    };
+    let mut errors = errors;
+    let mut points = Vec::with_capacity(entries.len());
+    let mut returned = Vec::with_capacity(entries.len());
+    let mut inputs = Vec::with_capacity(entries.len());
+    let mut proofs = Vec::new();
+    let mut proof_indices = Vec::new();
+    let mut unproven_points = Vec::new();
+    for ((((entry, evaluation), index), input), proved) in entries
+        .into_iter()
+        .zip(evaluations)
+        .zip(indices)
+        .zip(valid)
+        .zip(proved)
+    {
+        let unproven = unproven_evaluations
+            .as_mut()
+            .map(|evaluations| evaluations.next().expect("an evaluation per point"))
+            .transpose();
+        let (evaluation, unproven) = match evaluation.and_then(|e| Ok((e, unproven?))) {
+            Ok(evaluations) => evaluations,
+            Err(source) => {
+                let error = Error::EvalFailed {
+                    epoch,
+                    index,
+                    source,
+                };
+                let Some(errors) = errors.as_mut() else {
+                    return Err(error);
+                };
+                errors.push(error.into());
+                continue;
+            }
+        };
+        returned.push(index);
+        inputs.push(input);
+        if proved {
+            let proof = evaluation.proof.ok_or(Error::ProofMissing(index))?;
+            let proof = proof.serialize_to_bincode().map_err(Error::Serialization)?;
+            proofs.push(request.encoding.encode(&proof));
+            proof_indices.push(index);
+        }
+        if let Some(unproven) = unproven {
+            let encoded = request.encoding.encode(output_bytes(&unproven.output));
+            unproven_points.push(entry.clone().with_point(encoded));
+        }
+        let output = output_bytes(&evaluation.output);
+        let encoded = match &hkdf {
+            Some((salt, info, length)) => {
+                let mut okm = vec![0u8; *length];
+                Hkdf::<Sha256>::new(Some(salt), output)
+                    .expand(info, &mut okm)
+                    .map_err(|_| Error::BadHkdfLength(*length))?;
+                request.encoding.encode(&okm)
+            }
+            None => request.encoding.encode(output),
+        };
+        points.push(entry.with_point(encoded));
+    }
+    if let Some(errors) = errors.as_mut() {
+        errors.sort_by_key(|error| error.index);
+    }
+    let shuffle_seed = request
+        .include_shuffle_seed
+        .then(|| request.encoding.encode(&shuffle_seed(epoch, &inputs)));
+    Ok(RandomnessResponse {
+        points: Some(points),
+        indices: errors.is_some().then_some(returned),
+        errors,
+        proofs: verifiable.then_some(proofs),
+        proof_indices: request.proof_indices.is_some().then_some(proof_indices),
+        unproven_points: request.both.then_some(unproven_points),
+        count: None,
+        epoch,
+        epoch_start_time,
+        next_epoch_time,
+        shuffle_seed,
+        key_commitment,
+        public_key,
+    })
+}
+
+/// Outcome of evaluating a single point
+type EvalResult = std::result::Result<ppoprf::Evaluation, ppoprf::PPRFError>;
+
+/// Evaluate points, with proofs for those where `proved` is set
+/// Results are in one-to-one correspondence with the points.
+fn eval_selected(
+    state: &OPRFInstance,
+    points: &[ppoprf::Point],
+    proved: &[bool],
+    epoch: u8,
+    deadline: Option<Instant>,
+) -> std::result::Result<Vec<EvalResult>, EvalError> {
+    let select = |verifiable: bool| -> Vec<ppoprf::Point> {
+        points
+            .iter()
+            .zip(proved)
+            .filter(|(_, &proved)| proved == verifiable)
+            .map(|(point, _)| *point)
+            .collect()
+    };
+    let mut with_proofs = state.eval_each(&select(true), epoch, true, deadline)?.into_iter();
+    let mut without = state.eval_each(&select(false), epoch, false, deadline)?.into_iter();
+    Ok(proved
+        .iter()
+        .map(|&proved| {
+            let next = if proved { with_proofs.next() } else { without.next() };
+            next.expect("an evaluation per point")
+        })
+        .collect())
+}
+
+/// Process PPOPRF evaluation requests
+/// Requests and responses may be either JSON or CBOR-encoded.
+#[instrument(skip(state, request))]
+async fn randomness(
+    state: OPRFState,
+    instance_name: String,
+    request: Request,
+) -> Result<Response> {
+    let headers = request.headers().clone();
+    let request: RandomnessRequest =
+        decode_randomness::<_, StrictRandomnessRequest>(&state, request).await?;
+    debug!("recv: {request:?}");
+    let deadlines = Deadlines::start(&state);
+    let in_flight = InFlight::start(&state)?;
+    let response = in_flight
+        .run(move || evaluate_instance(&state, &instance_name, request, deadlines))
+        .await?;
     debug!("send: {response:?}");
-    Ok(Json(response))
+    negotiate(&headers, response)
+}
+
+/// Count randomness requests by instance and outcome
+/// Used with `from_fn_with_state` on the randomness routes, outside
+/// the other layers, so requests they reject are counted too.
+pub async fn count_requests(
+    State(state): State<OPRFState>,
+    instance_name: Option<Path<String>>,
+    request: Request,
+    next: Next,
+) -> Response {
+    // Label unknown instances alike, so clients can't create a
+    // series for every name they try.
+    let instance_name = match instance_name {
+        Some(Path(instance_name)) if state.instances.contains_key(&instance_name) => {
+            instance_name
+        }
+        Some(_) => "unknown".to_string(),
+        None => state.default_instance.clone(),
+    };
+    let response = next.run(request).await;
+    let status = response.status();
+    let outcome = if status.is_success() {
+        "ok"
+    } else if status.is_client_error() {
+        "rejected"
+    } else {
+        "failed"
+    };
+    counter!(
+        "randomness_requests_total",
+        "instance" => instance_name,
+        "outcome" => outcome
+    )
+    .increment(1);
+    response
+}
+
+/// Apply a per-client rate limit, if enabled, to a request
+async fn limit_rate(
+    state: &OPRFServer,
+    limiter: Option<&RateLimiter>,
+    request: Request,
+    next: Next,
+) -> Result<Response> {
+    if let Some(limiter) = limiter {
+        // Requests without a known address, as in tests, aren't limited.
+        if let Some(client) = client_addr(state, &request) {
+            limiter
+                .check(client, tokio::time::Instant::now())
+                .map_err(Error::RateLimited)?;
+        }
+    }
+    Ok(next.run(request).await)
+}
+
+/// Apply the per-client rate limit to randomness requests
+/// Used with `from_fn_with_state` on the randomness routes.
+pub async fn rate_limit(
+    State(state): State<OPRFState>,
+    request: Request,
+    next: Next,
+) -> Result<Response> {
+    limit_rate(&state, state.rate_limiter.as_ref(), request, next).await
+}
+
+/// Apply the per-client rate limit to metadata requests
+/// Used with `from_fn_with_state` on the info and other
+/// metadata routes.
+pub async fn rate_limit_info(
+    State(state): State<OPRFState>,
+    request: Request,
+    next: Next,
+) -> Result<Response> {
+    limit_rate(&state, state.info_rate_limiter.as_ref(), request, next).await
+}
+
+/// Apply the per-client rate limit to verify requests
+/// Used with `from_fn_with_state` on the verify routes.
+pub async fn rate_limit_verify(
+    State(state): State<OPRFState>,
+    request: Request,
+    next: Next,
+) -> Result<Response> {
+    limit_rate(&state, state.verify_rate_limiter.as_ref(), request, next).await
+}
+
+/// Handle CORS for requests from browsers
+/// Answers preflight requests from allowed origins with 204 No
+/// Content, and adds CORS headers to the responses to other
+/// requests from them. Used with `from_fn_with_state` on all routes.
+pub async fn cors(State(state): State<OPRFState>, request: Request, next: Next) -> Response {
+    let Some(origin) = allowed_origin(&state, request.headers()) else {
+        return next.run(request).await;
+    };
+    let preflight = request.method() == Method::OPTIONS
+        && request
+            .headers()
+            .contains_key(header::ACCESS_CONTROL_REQUEST_METHOD);
+    let mut response = if preflight {
+        StatusCode::NO_CONTENT.into_response()
+    } else {
+        next.run(request).await
+    };
+    let headers = response.headers_mut();
+    if origin != "*" {
+        // Caches must not reuse a response for other origins.
+        headers.append(header::VARY, HeaderValue::from_static("Origin"));
+    }
+    headers.insert(header::ACCESS_CONTROL_ALLOW_ORIGIN, origin);
+    headers.insert(
+        header::ACCESS_CONTROL_ALLOW_METHODS,
+        HeaderValue::from_static(CORS_ALLOW_METHODS),
+    );
+    headers.insert(
+        header::ACCESS_CONTROL_ALLOW_HEADERS,
+        HeaderValue::from_static(CORS_ALLOW_HEADERS),
+    );
+    headers.insert(
+        header::ACCESS_CONTROL_EXPOSE_HEADERS,
+        HeaderValue::from_static(CORS_EXPOSE_HEADERS),
+    );
+    response
+}
+
+/// Value of `Access-Control-Allow-Origin` for a request, if it's
+/// from an allowed origin
+fn allowed_origin(state: &OPRFServer, headers: &HeaderMap) -> Option<HeaderValue> {
+    let origin = headers.get(header::ORIGIN)?;
+    if state.cors_origins.iter().any(|allowed| allowed == "*") {
+        return Some(HeaderValue::from_static("*"));
+    }
+    state
+        .cors_origins
+        .iter()
+        .any(|allowed| allowed.as_bytes() == origin.as_bytes())
+        .then(|| origin.clone())
+}
+
+/// Address of the client making a request
+/// This is reported by the trusted proxy header if configured and
+/// present, falling back to the peer address of the connection.
+fn client_addr(state: &OPRFServer, request: &Request) -> Option<IpAddr> {
+    let forwarded = state.client_ip_header.as_deref().and_then(|name| {
+        // A proxy appends the address it saw to any the client
+        // claimed, so only the last one can be trusted.
+        let value = request.headers().get_all(name).iter().last()?;
+        value.to_str().ok()?.rsplit(',').next()?.trim().parse().ok()
+    });
+    forwarded.or_else(|| {
+        let ConnectInfo(addr) = request.extensions().get::<ConnectInfo<SocketAddr>>()?;
+        Some(addr.ip())
+    })
+}
+
+/// Slot held by a randomness request while it's evaluated
+/// Holds a permit if concurrent evaluations are limited, and keeps
+/// the in-flight gauge up to date.
+struct InFlight {
+    _permit: Option<OwnedSemaphorePermit>,
+}
+
+impl InFlight {
+    /// Claim a slot, failing if all are taken
+    fn start(server: &OPRFServer) -> Result<Self> {
+        let _permit = match &server.eval_permits {
+            Some(permits) => Some(
+                permits
+                    .clone()
+                    .try_acquire_owned()
+                    .map_err(|_| Error::Overloaded)?,
+            ),
+            None => None,
+        };
+        gauge!("randomness_in_flight").increment(1.0);
+        Ok(InFlight { _permit })
+    }
+
+    /// Evaluate on a blocking thread, keeping the slot until it's done
+    /// Evaluations check their own deadlines, so the slot is only
+    /// released once the work has actually stopped, even if the
+    /// request is dropped before then.
+    async fn run<T, F>(self, evaluate: F) -> Result<T>
+    where
+        T: Send + 'static,
+        F: FnOnce() -> Result<T> + Send + 'static,
+    {
+        let task = tokio::task::spawn_blocking(move || {
+            let _in_flight = self;
+            evaluate()
+        });
+        task.await.map_err(|_| Error::Panic)?
+    }
+}
+
+impl Drop for InFlight {
+    fn drop(&mut self) {
+        gauge!("randomness_in_flight").decrement(1.0);
+    }
+}
+
+/// Evaluate a request with the named instance, recording metrics
+fn evaluate_instance(
+    server: &OPRFState,
+    instance_name: &str,
+    request: RandomnessRequest,
+    deadlines: Deadlines,
+) -> Result<RandomnessResponse> {
+    let state = get_server_from_state(server, instance_name)?;
+    check_fresh(server, &state)?;
+    let start = Instant::now();
+    let response = evaluate(server, &state, request, deadlines)?;
+    record_evaluation(server, instance_name, response.epoch, response.evaluated(), start);
+    Ok(response)
 }
 
 /// Process PPOPRF evaluation requests using default instance
 pub async fn default_instance_randomness(
     State(state): State<OPRFState>,
-    Json(request): Json<RandomnessRequest>,
-) -> Result<Json<RandomnessResponse>> {
+    request: Request,
+) -> Result<Response> {
     let instance_name = state.default_instance.clone();
     randomness(state, instance_name, request).await
 }
@@ -179,40 +1772,774 @@ pub async fn default_instance_randomness(
 pub async fn specific_instance_randomness(
     State(state): State<OPRFState>,
     Path(instance_name): Path<String>,
-    Json(request): Json<RandomnessRequest>,
-) -> Result<Json<RandomnessResponse>> {
+    request: Request,
+) -> Result<Response> {
     randomness(state, instance_name, request).await
 }
 
+/// Process PPOPRF evaluation requests in the raw binary format
+///
+/// The request body is a sequence of 32-byte compressed Ristretto
+/// points, evaluated in the current epoch. The response body is the
+/// epoch as a single byte, then the number of points as a 32-bit
+/// unsigned integer in network (big-endian) byte order, then the
+/// 32-byte compressed output points, in the same order as the
+/// request points. Points are in their canonical encoding, with
+/// no byte reordering.
+#[instrument(skip(state, body))]
+async fn raw_randomness(
+    state: OPRFState,
+    instance_name: String,
+    body: Bytes,
+) -> Result<Response> {
+    debug!("recv: {} bytes", body.len());
+    if body.len() % ppoprf::COMPRESSED_POINT_LEN != 0 {
+        return Err(Error::BadPoint);
+    }
+    let count = body.len() / ppoprf::COMPRESSED_POINT_LEN;
+    if count > state.max_points {
+        return Err(Error::TooManyPoints(state.max_points));
+    }
+    let deadlines = Deadlines::start(&state);
+    let in_flight = InFlight::start(&state)?;
+    let output = in_flight
+        .run(move || evaluate_raw(&state, &instance_name, &body, deadlines))
+        .await?;
+    debug!("send: {} bytes", output.len());
+    Ok(([(header::CONTENT_TYPE, RAW_MEDIA_TYPE)], output).into_response())
+}
+
+/// Evaluate the points of a raw request with the named instance,
+/// recording metrics
+fn evaluate_raw(
+    server: &OPRFState,
+    instance_name: &str,
+    body: &[u8],
+    deadlines: Deadlines,
+) -> Result<Vec<u8>> {
+    let count = body.len() / ppoprf::COMPRESSED_POINT_LEN;
+    let state = get_server_from_state(server, instance_name)?;
+    check_fresh(server, &state)?;
+    let start = Instant::now();
+    let epoch = state.epoch;
+    let mut output = Vec::with_capacity(5 + count * OUTPUT_LENGTH);
+    output.push(epoch);
+    // The request body limit bounds the count well within u32.
+    output.extend_from_slice(&(count as u32).to_be_bytes());
+    let points = body
+        .chunks_exact(ppoprf::COMPRESSED_POINT_LEN)
+        .enumerate()
+        .map(|(index, input)| point_from_bytes(input).map_err(|e| e.at_point(index)))
+        .collect::<Result<Vec<_>>>()?;
+    let evaluations = state
+        .eval(&points, epoch, false, deadlines.eval)
+        .map_err(|e| eval_error(e, epoch, |index| index))?;
+    for evaluation in evaluations {
+        output.extend_from_slice(output_bytes(&evaluation.output));
+    }
+    record_evaluation(server, instance_name, epoch, count, start);
+    Ok(output)
+}
+
+/// Process raw PPOPRF evaluation requests using default instance
+pub async fn default_instance_raw_randomness(
+    State(state): State<OPRFState>,
+    body: Bytes,
+) -> Result<Response> {
+    let instance_name = state.default_instance.clone();
+    raw_randomness(state, instance_name, body).await
+}
+
+/// Process raw PPOPRF evaluation requests using specific instance
+pub async fn specific_instance_raw_randomness(
+    State(state): State<OPRFState>,
+    Path(instance_name): Path<String>,
+    body: Bytes,
+) -> Result<Response> {
+    raw_randomness(state, instance_name, body).await
+}
+
+/// Process a batch of independent PPOPRF evaluation requests
+/// The total number of points across the batch is bounded
+/// by the same limit as a single request, as is the total number
+/// of proofs.
+#[instrument(skip(state, request))]
+async fn multi_randomness(
+    state: OPRFState,
+    instance_name: String,
+    request: Request,
+) -> Result<Response> {
+    let headers = request.headers().clone();
+    let requests: Vec<RandomnessRequest> =
+        decode_randomness::<_, StrictRandomnessBatch>(&state, request).await?;
+    debug!("recv: {} requests", requests.len());
+    let total_points: usize = requests.iter().map(|r| r.points.len()).sum();
+    if total_points > state.max_points {
+        return Err(Error::TooManyPoints(state.max_points));
+    }
+    let total_proofs: usize = requests.iter().map(RandomnessRequest::proof_count).sum();
+    if total_proofs > state.max_verifiable_points {
+        return Err(Error::TooManyProofs(state.max_verifiable_points));
+    }
+    // The time limits apply to the batch as a whole.
+    let deadlines = Deadlines::start(&state);
+    let in_flight = InFlight::start(&state)?;
+    let results = in_flight
+        .run(move || evaluate_batch(&state, &instance_name, requests, deadlines))
+        .await?;
+    debug!("send: {results:?}");
+    negotiate(&headers, results)
+}
+
+/// Evaluate a batch of requests with the named instance, recording
+/// metrics
+/// Running out of time fails the batch as a whole.
+fn evaluate_batch(
+    server: &OPRFState,
+    instance_name: &str,
+    requests: Vec<RandomnessRequest>,
+    deadlines: Deadlines,
+) -> Result<Vec<MultiRandomnessResult>> {
+    let state = get_server_from_state(server, instance_name)?;
+    check_fresh(server, &state)?;
+    let mut results = Vec::with_capacity(requests.len());
+    for request in requests {
+        let start = Instant::now();
+        let result = evaluate(server, &state, request, deadlines);
+        if let Ok(response) = &result {
+            let points = response.evaluated();
+            record_evaluation(server, instance_name, response.epoch, points, start);
+        }
+        results.push(match result {
+            Ok(response) => MultiRandomnessResult::Ok(response),
+            Err(e @ (Error::ParseTimeout | Error::EvalTimeout)) => return Err(e),
+            Err(e) => MultiRandomnessResult::Err(e.into()),
+        });
+    }
+    Ok(results)
+}
+
+/// Process batched PPOPRF evaluation requests using default instance
+pub async fn default_instance_multi_randomness(
+    State(state): State<OPRFState>,
+    request: Request,
+) -> Result<Response> {
+    let instance_name = state.default_instance.clone();
+    multi_randomness(state, instance_name, request).await
+}
+
+/// Process batched PPOPRF evaluation requests using specific instance
+pub async fn specific_instance_multi_randomness(
+    State(state): State<OPRFState>,
+    Path(instance_name): Path<String>,
+    request: Request,
+) -> Result<Response> {
+    multi_randomness(state, instance_name, request).await
+}
+
 /// Provide PPOPRF epoch and key metadata
-#[instrument(skip(state))]
-async fn info(state: OPRFState, instance_name: String) -> Result<Json<InfoResponse>> {
+#[instrument(skip(state, headers))]
+async fn info(
+    state: OPRFState,
+    instance_name: String,
+    query: InfoQuery,
+    headers: HeaderMap,
+) -> Result<Response> {
     debug!("recv: info request");
+    let at = match query.at {
+        Some(at) => Some(parse_timestamp(&at).map_err(|_| Error::BadTimestamp(at))?),
+        None => None,
+    };
+    let max_points = state.max_points;
+    let max_verifiable_points = state.max_verifiable_points;
+    let max_request_bytes = state.max_request_bytes;
+    let epoch_offset = state.epoch_offset;
+    let epoch_offset_ms = epoch_offset.as_millis() as u64;
+    let now = state.now();
+    if at.is_some_and(|at| at > now + MAX_SCHEDULE_LOOKAHEAD) {
+        return Err(Error::TimestampTooLate);
+    }
+    let latency = match &state.latency {
+        Some(window) => {
+            let window = window.lock().unwrap_or_else(|e| e.into_inner());
+            window.percentiles([50, 95, 99]).map(|[p50, p95, p99]| Latency {
+                samples: window.sample_count(),
+                p50_micros: p50.as_micros() as u64,
+                p95_micros: p95.as_micros() as u64,
+                p99_micros: p99.as_micros() as u64,
+            })
+        }
+        None => None,
+    };
     let state = get_server_from_state(&state, &instance_name)?;
-    let public_key = state.server.get_public_key().serialize_to_bincode()?;
+    let public_key = state
+        .server
+        .get_public_key()
+        .serialize_to_bincode()
+        .map_err(Error::Serialization)?;
     let public_key = BASE64.encode(public_key);
-    let response = InfoResponse {
+    let next_public_key = match state.next_public_key() {
+        Some(key) => {
+            let key = key.serialize_to_bincode().map_err(Error::Serialization)?;
+            Some(BASE64.encode(key))
+        }
+        None => None,
+    };
+    let key_history = state
+        .key_history
+        .iter()
+        .map(|key| {
+            let public_key = key.public_key.serialize_to_bincode().map_err(Error::Serialization)?;
+            Ok(KeyHistoryEntry {
+                generation: key.generation,
+                epoch: key.epoch,
+                public_key: BASE64.encode(public_key),
+            })
+        })
+        .collect::<Result<_>>()?;
+    let mut response = InfoResponse {
         current_epoch: state.epoch,
+        remaining_epochs: state.last_epoch - state.epoch,
         next_epoch_time: state.next_epoch_time.clone(),
-        max_points: crate::MAX_POINTS,
+        seconds_until_next_epoch: state
+            .epoch_deadline
+            .map(|deadline| (deadline - now).whole_seconds().max(0)),
+        epoch_len_seconds: state
+            .epoch_start
+            .zip(state.epoch_deadline)
+            .map(|(start, deadline)| (deadline - start).whole_seconds()),
+        next_key_rotation_time: state.next_key_rotation_time.clone(),
+        key_history,
+        max_points,
+        max_verifiable_points,
+        max_request_bytes,
+        proofs_supported: PROOFS_SUPPORTED,
+        curve: CURVE,
+        hash: HASH,
+        output_length: OUTPUT_LENGTH,
+        epoch_offset_ms,
+        latency,
+        public_key_fingerprint: state.public_key_fingerprint.clone(),
         public_key,
+        next_public_key,
     };
+    let schedule = state.schedule;
+    let epochs = state.first_epoch..=state.last_epoch;
+    drop(state);
+    // Report the epoch in effect at the requested time instead.
+    if let Some(at) = at {
+        let schedule = schedule.ok_or(Error::ScheduleUnavailable)?;
+        let (epoch, start, next_rotation) = schedule
+            .epoch_at(epochs.clone(), at)
+            .ok_or(Error::TimestampBeforeBase)?;
+        response.current_epoch = epoch;
+        response.remaining_epochs = epochs.end() - epoch;
+        response.next_epoch_time = Some(rotation_timestamp(next_rotation, epoch_offset));
+        response.seconds_until_next_epoch = Some((next_rotation - at).whole_seconds());
+        response.epoch_len_seconds = Some((next_rotation - start).whole_seconds());
+    }
     debug!("send: {response:?}");
-    Ok(Json(response))
+    negotiate(&headers, response)
 }
 
 /// Provide PPOPRF epoch and key metadata using default instance
-pub async fn default_instance_info(State(state): State<OPRFState>) -> Result<Json<InfoResponse>> {
+pub async fn default_instance_info(
+    State(state): State<OPRFState>,
+    query: Result<Query<InfoQuery>, QueryRejection>,
+    headers: HeaderMap,
+) -> Result<Response> {
     let instance_name = state.default_instance.clone();
-    info(state, instance_name).await
+    info(state, instance_name, query?.0, headers).await
 }
 
 /// Provide PPOPRF epoch and key metadata using specific instance
 pub async fn specific_instance_info(
     State(state): State<OPRFState>,
     Path(instance_name): Path<String>,
-) -> Result<Json<InfoResponse>> {
-    info(state, instance_name).await
+    query: Result<Query<InfoQuery>, QueryRejection>,
+    headers: HeaderMap,
+) -> Result<Response> {
+    info(state, instance_name, query?.0, headers).await
+}
+
+/// Report when the public key of an instance will next change
+#[instrument(skip(state))]
+async fn status(state: OPRFState, instance_name: String) -> Result<Json<StatusResponse>> {
+    debug!("recv: status request");
+    let paused = state.paused.load(Ordering::Relaxed);
+    let now = state.now();
+    let state = get_server_from_state(&state, &instance_name)?;
+    let key_change = state.next_key_change();
+    let response = StatusResponse {
+        current_epoch: state.epoch,
+        remaining_epochs: state.last_epoch - state.epoch,
+        next_key_change_time: key_change.and_then(|time| time.format(&Rfc3339).ok()),
+        seconds_until_key_change: key_change.map(|time| (time - now).whole_seconds()),
+        paused,
+        eval_cache_entries: state
+            .eval_cache
+            .as_ref()
+            .map(|cache| EvalCache::lock(cache).len()),
+    };
+    debug!("send: {response:?}");
+    Ok(Json(response))
+}
+
+/// Report when the public key will next change using default instance
+pub async fn default_instance_status(
+    State(state): State<OPRFState>,
+) -> Result<Json<StatusResponse>> {
+    let instance_name = state.default_instance.clone();
+    status(state, instance_name).await
+}
+
+/// Report when the public key will next change using specific instance
+pub async fn specific_instance_status(
+    State(state): State<OPRFState>,
+    Path(instance_name): Path<String>,
+) -> Result<Json<StatusResponse>> {
+    status(state, instance_name).await
+}
+
+/// Report the epochs overlapping a time range
+/// This is pure schedule math, so clients can plan how many
+/// distinct outputs an input would produce over that time.
+#[instrument(skip(state))]
+async fn epoch_span(
+    state: OPRFState,
+    instance_name: String,
+    query: EpochSpanQuery,
+) -> Result<Json<EpochSpanResponse>> {
+    debug!("recv: epoch span request");
+    let from = parse_timestamp(&query.from).map_err(|_| Error::BadTimestamp(query.from))?;
+    let to = parse_timestamp(&query.to).map_err(|_| Error::BadTimestamp(query.to))?;
+    if to < from {
+        return Err(Error::BadTimeRange);
+    }
+    if from > state.now() + MAX_SCHEDULE_LOOKAHEAD {
+        return Err(Error::TimestampTooLate);
+    }
+    let (schedule, epochs) = {
+        let state = get_server_from_state(&state, &instance_name)?;
+        (state.schedule, state.first_epoch..=state.last_epoch)
+    };
+    let schedule = schedule.ok_or(Error::ScheduleUnavailable)?;
+    let epochs = schedule
+        .epochs_between(epochs, from, to, MAX_EPOCH_SPAN)
+        .ok_or(Error::BadTimeRange)?;
+    let response = EpochSpanResponse {
+        count: epochs.len(),
+        epochs,
+    };
+    debug!("send: {response:?}");
+    Ok(Json(response))
+}
+
+/// Report the epochs overlapping a time range using default instance
+pub async fn default_instance_epoch_span(
+    State(state): State<OPRFState>,
+    query: Result<Query<EpochSpanQuery>, QueryRejection>,
+) -> Result<Json<EpochSpanResponse>> {
+    let instance_name = state.default_instance.clone();
+    epoch_span(state, instance_name, query?.0).await
+}
+
+/// Report the epochs overlapping a time range using specific instance
+pub async fn specific_instance_epoch_span(
+    State(state): State<OPRFState>,
+    Path(instance_name): Path<String>,
+    query: Result<Query<EpochSpanQuery>, QueryRejection>,
+) -> Result<Json<EpochSpanResponse>> {
+    epoch_span(state, instance_name, query?.0).await
+}
+
+/// List the epochs of the current key, one page at a time
+#[instrument(skip(state))]
+async fn schedule(
+    state: OPRFState,
+    instance_name: String,
+    query: ScheduleQuery,
+) -> Result<Json<ScheduleResponse>> {
+    debug!("recv: schedule request");
+    let max_entries = state.max_schedule_entries;
+    let limit = query.limit.unwrap_or(DEFAULT_SCHEDULE_PAGE.min(max_entries));
+    if limit == 0 {
+        return Err(Error::BadPageLimit(limit));
+    }
+    let truncated = limit > max_entries;
+    let limit = limit.min(max_entries);
+    let state = get_server_from_state(&state, &instance_name)?;
+    // Upcoming epochs follow the next rotation at regular intervals.
+    let next_rotation = state
+        .next_epoch_time
+        .as_deref()
+        .and_then(|stamp| parse_timestamp(stamp).ok());
+    let start_time = |epoch: u8| {
+        let schedule = state.schedule?;
+        let mut start = next_rotation?;
+        for _ in 1..epoch.saturating_sub(state.epoch) {
+            start = start + schedule.epoch_duration;
+        }
+        start.format(&Rfc3339).ok()
+    };
+    let epochs = state.first_epoch..=state.last_epoch;
+    let total = epochs.len();
+    let epochs: Vec<_> = epochs
+        .skip(query.offset)
+        .take(limit)
+        .map(|epoch| {
+            let status = if state.punctured.contains(&epoch) {
+                EpochStatus::Punctured
+            } else if epoch == state.epoch {
+                EpochStatus::Current
+            } else {
+                EpochStatus::Upcoming
+            };
+            let start_time = match status {
+                EpochStatus::Upcoming => start_time(epoch),
+                _ => None,
+            };
+            ScheduleEntry {
+                epoch,
+                status,
+                start_time,
+            }
+        })
+        .collect();
+    let end = query.offset.saturating_add(epochs.len());
+    let response = ScheduleResponse {
+        epochs,
+        total,
+        next_offset: (end < total).then_some(end),
+        truncated,
+    };
+    debug!("send: {response:?}");
+    Ok(Json(response))
+}
+
+/// List the epochs of the current key using default instance
+pub async fn default_instance_schedule(
+    State(state): State<OPRFState>,
+    query: Result<Query<ScheduleQuery>, QueryRejection>,
+) -> Result<Json<ScheduleResponse>> {
+    let instance_name = state.default_instance.clone();
+    schedule(state, instance_name, query?.0).await
+}
+
+/// List the epochs of the current key using specific instance
+pub async fn specific_instance_schedule(
+    State(state): State<OPRFState>,
+    Path(instance_name): Path<String>,
+    query: Result<Query<ScheduleQuery>, QueryRejection>,
+) -> Result<Json<ScheduleResponse>> {
+    schedule(state, instance_name, query?.0).await
+}
+
+/// Key to check a verify request's proof with
+/// The key is either given in the request, so clients can confirm
+/// earlier outputs with the key they were published with, or taken
+/// from the instance's key history by generation. History keys are
+/// cloned, so the instance lock is only held to look them up.
+fn verify_key(
+    server: &OPRFState,
+    instance_name: &str,
+    request: &VerifyRequest,
+) -> Result<ppoprf::ServerPublicKey> {
+    match (&request.public_key, request.generation) {
+        (Some(public_key), None) => {
+            if !server.instances.contains_key(instance_name) {
+                return Err(Error::InstanceNotFound(instance_name.to_string()));
+            }
+            Ok(ppoprf::ServerPublicKey::load_from_bincode(
+                &BASE64.decode(public_key)?,
+            )?)
+        }
+        (None, Some(generation)) => get_server_from_state(server, instance_name)?
+            .public_key_for(generation)
+            .cloned()
+            .ok_or(Error::KeyGenerationUnavailable(generation)),
+        _ => Err(Error::VerifyKeyChoice),
+    }
+}
+
+/// Check a proof returned with a verifiable evaluation
+fn verify_proof(
+    public_key: &ppoprf::ServerPublicKey,
+    request: &VerifyRequest,
+) -> Result<VerifyResponse> {
+    let encoding = request.encoding;
+    let input = encoding.decode(&request.input)?;
+    let output = encoding.decode(&request.output)?;
+    let proof = ppoprf::ProofDLEQ::load_from_bincode(&encoding.decode_bytes(&request.proof)?)?;
+    let evaluation = ppoprf::Evaluation {
+        output,
+        proof: Some(proof),
+    };
+    let valid = ppoprf::Client::verify(public_key, &input, &evaluation, request.epoch);
+    Ok(VerifyResponse { valid })
+}
+
+/// Check a proof against an instance's keys
+/// Proofs are checked on a blocking thread, like evaluations, and
+/// count towards the same concurrency limit.
+#[instrument(skip(state, request))]
+async fn verify(state: OPRFState, instance_name: String, request: Request) -> Result<Response> {
+    let headers = request.headers().clone();
+    let request: VerifyRequest = decode_body(request).await?;
+    debug!("recv: {request:?}");
+    let public_key = verify_key(&state, &instance_name, &request)?;
+    let response = InFlight::start(&state)?
+        .run(move || verify_proof(&public_key, &request))
+        .await?;
+    negotiate(&headers, response)
+}
+
+/// Check a batch of proofs against an instance's keys
+/// Each tuple may name a different key generation, so outputs
+/// spanning a key rotation can be checked in one call. Errors are
+/// attributed to the index of the tuple which caused them. A batch
+/// holds at most as many proofs as a verifiable request returns,
+/// checked within the evaluation deadline.
+#[instrument(skip(state, request))]
+async fn multi_verify(
+    state: OPRFState,
+    instance_name: String,
+    request: Request,
+) -> Result<Response> {
+    let headers = request.headers().clone();
+    let requests: Vec<VerifyRequest> = decode_body(request).await?;
+    debug!("recv: {requests:?}");
+    let max_proofs = state.max_verifiable_points;
+    if requests.len() > max_proofs {
+        return Err(Error::TooManyProofs(max_proofs));
+    }
+    let public_keys = requests
+        .iter()
+        .enumerate()
+        .map(|(index, request)| {
+            verify_key(&state, &instance_name, request).map_err(|e| e.at_point(index))
+        })
+        .collect::<Result<Vec<_>>>()?;
+    let deadlines = Deadlines::start(&state);
+    let responses = InFlight::start(&state)?
+        .run(move || {
+            requests
+                .iter()
+                .zip(&public_keys)
+                .enumerate()
+                .map(|(index, (request, public_key))| {
+                    deadlines.check_eval()?;
+                    verify_proof(public_key, request).map_err(|e| e.at_point(index))
+                })
+                .collect::<Result<Vec<_>>>()
+        })
+        .await?;
+    negotiate(&headers, responses)
+}
+
+/// Check a proof using default instance
+pub async fn default_instance_verify(
+    State(state): State<OPRFState>,
+    request: Request,
+) -> Result<Response> {
+    let instance_name = state.default_instance.clone();
+    verify(state, instance_name, request).await
+}
+
+/// Check a proof using specific instance
+pub async fn specific_instance_verify(
+    State(state): State<OPRFState>,
+    Path(instance_name): Path<String>,
+    request: Request,
+) -> Result<Response> {
+    verify(state, instance_name, request).await
+}
+
+/// Check a batch of proofs using default instance
+pub async fn default_instance_multi_verify(
+    State(state): State<OPRFState>,
+    request: Request,
+) -> Result<Response> {
+    let instance_name = state.default_instance.clone();
+    multi_verify(state, instance_name, request).await
+}
+
+/// Check a batch of proofs using specific instance
+pub async fn specific_instance_multi_verify(
+    State(state): State<OPRFState>,
+    Path(instance_name): Path<String>,
+    request: Request,
+) -> Result<Response> {
+    multi_verify(state, instance_name, request).await
+}
+
+/// Report whether every instance is rotating epochs on schedule
+/// Instances are not ready until their first epoch has begun.
+pub async fn readiness(State(state): State<OPRFState>) -> Result<StatusCode> {
+    for instance in state.instances.values() {
+        if instance.read()?.schedule.is_none() {
+            return Ok(StatusCode::SERVICE_UNAVAILABLE);
+        }
+    }
+    Ok(StatusCode::OK)
+}
+
+/// Compressed Ristretto basepoint, evaluated by the health check
+const HEALTH_CHECK_POINT: [u8; ppoprf::COMPRESSED_POINT_LEN] = [
+    0xe2, 0xf2, 0xae, 0x0a, 0x6a, 0xbc, 0x4e, 0x71, 0xa8, 0x84, 0xa9, 0x61, 0xc5, 0x00, 0x51, 0x5f,
+    0x58, 0xe3, 0x0b, 0x6a, 0xa5, 0x82, 0xdd, 0x8d, 0xb6, 0xa6, 0x59, 0x45, 0xe0, 0x8d, 0x2d, 0x76,
+];
+
+/// Confirm an instance can evaluate a point in its current epoch
+/// The read lock is only held for the single evaluation.
+fn check_health(instance: &RwLock<OPRFInstance>) -> Result<()> {
+    let state = instance.read()?;
+    let point = ppoprf::Point::from(HEALTH_CHECK_POINT.as_slice());
+    state.server.eval(&point, state.epoch, false)?;
+    Ok(())
+}
+
+/// Report whether every instance is able to evaluate
+/// Unlike readiness, this doesn't depend on the epoch schedule
+/// or on serving being paused.
+pub async fn health(State(state): State<OPRFState>) -> (StatusCode, Json<HealthResponse>) {
+    for (instance_name, instance) in &state.instances {
+        if let Err(e) = check_health(instance) {
+            warn!(instance_name, "health check failed: {e}");
+            let response = HealthResponse {
+                status: "unavailable",
+                reason: Some(format!("instance '{instance_name}': {e}")),
+            };
+            return (StatusCode::SERVICE_UNAVAILABLE, Json(response));
+        }
+    }
+    let response = HealthResponse {
+        status: "ok",
+        reason: None,
+    };
+    (StatusCode::OK, Json(response))
+}
+
+/// Respond to a panic in a request handler
+/// Used with `CatchPanicLayer`, so a bug fails the request with a
+/// JSON error rather than dropping the connection. The panic hook
+/// has already reported where the panic happened.
+pub fn panic_response(panic: Box<dyn Any + Send + 'static>) -> Response {
+    let message = match panic.downcast_ref::<&str>() {
+        Some(message) => message,
+        None => panic.downcast_ref::<String>().map_or("unknown", String::as_str),
+    };
+    error!("request handler panicked: {message}");
+    Error::Panic.into_response()
+}
+
+/// Check a request carries the admin bearer token
+fn check_admin(state: &OPRFServer, headers: &HeaderMap) -> Result<()> {
+    let expected = state.admin_token.as_deref().ok_or(Error::Unauthorized)?;
+    check_bearer(expected, headers)
+}
+
+/// Require the configured bearer token on randomness requests
+/// Used with `from_fn_with_state` on the randomness routes.
+pub async fn authenticate(
+    State(state): State<OPRFState>,
+    request: Request,
+    next: Next,
+) -> Result<Response> {
+    if let Some(expected) = &state.auth_token {
+        check_bearer(expected, request.headers())?;
+    }
+    Ok(next.run(request).await)
+}
+
+/// Check a request carries the `expected` bearer token
+fn check_bearer(expected: &str, headers: &HeaderMap) -> Result<()> {
+    let token = headers
+        .get(header::AUTHORIZATION)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.strip_prefix("Bearer "))
+        .ok_or(Error::Unauthorized)?;
+    // Compare fixed-length digests in constant time, so neither
+    // the contents nor the length of the token leak.
+    let token = Sha256::digest(token.as_bytes());
+    let expected = Sha256::digest(expected.as_bytes());
+    if !bool::from(token.ct_eq(&expected)) {
+        return Err(Error::Unauthorized);
+    }
+    Ok(())
+}
+
+/// Stop serving randomness from all instances
+/// Other endpoints remain available for diagnosis.
+pub async fn pause(State(state): State<OPRFState>, headers: HeaderMap) -> Result<StatusCode> {
+    check_admin(&state, &headers)?;
+    state.paused.store(true, Ordering::Relaxed);
+    warn!("randomness serving paused");
+    Ok(StatusCode::NO_CONTENT)
+}
+
+/// Resume serving randomness after a pause
+pub async fn resume(State(state): State<OPRFState>, headers: HeaderMap) -> Result<StatusCode> {
+    check_admin(&state, &headers)?;
+    state.paused.store(false, Ordering::Relaxed);
+    warn!("randomness serving resumed");
+    Ok(StatusCode::NO_CONTENT)
+}
+
+/// Report which build of the server is running
+/// The git commit and build time are taken from the
+/// `STAR_RANDSRV_GIT_COMMIT` and `STAR_RANDSRV_BUILD_TIME`
+/// environment variables at build time, if set.
+pub async fn version() -> Json<VersionResponse> {
+    Json(VersionResponse {
+        version: env!("CARGO_PKG_VERSION"),
+        git_commit: option_env!("STAR_RANDSRV_GIT_COMMIT"),
+        build_time: option_env!("STAR_RANDSRV_BUILD_TIME"),
+        rustc_version: env!("STAR_RANDSRV_RUSTC_VERSION"),
+        ppoprf_version: env!("STAR_RANDSRV_PPOPRF_VERSION"),
+    })
+}
+
+/// Record a CPU profile over the requested number of seconds
+/// The response is a protobuf-encoded profile, as read by
+/// `go tool pprof` and similar tools.
+pub async fn cpu_profile(query: Result<Query<ProfileQuery>, QueryRejection>) -> Result<Response> {
+    let seconds = query?.0.seconds.unwrap_or(DEFAULT_PROFILE_SECONDS);
+    if !(1..=MAX_PROFILE_SECONDS).contains(&seconds) {
+        return Err(Error::BadProfileDuration(seconds));
+    }
+    // The profiler can't be held across an await, so sample
+    // from a blocking thread.
+    let task = tokio::task::spawn_blocking(move || {
+        let guard = pprof::ProfilerGuardBuilder::default()
+            .frequency(PROFILE_FREQUENCY)
+            .blocklist(&["libc", "libgcc", "pthread", "vdso"])
+            .build()?;
+        std::thread::sleep(Duration::from_secs(seconds));
+        let profile = guard.report().build()?.pprof()?;
+        let mut body = Vec::new();
+        profile
+            .encode(&mut body)
+            .map_err(|e| Error::Encoding(e.to_string()))?;
+        Ok::<_, Error>(body)
+    });
+    let body = task.await.map_err(|_| Error::Panic)??;
+    Ok(([(header::CONTENT_TYPE, RAW_MEDIA_TYPE)], body).into_response())
+}
+
+/// Report memory use statistics from the allocator
+pub async fn heap_stats() -> Result<Json<HeapResponse>> {
+    use tikv_jemalloc_ctl::{epoch, stats};
+
+    // Statistics are only refreshed when the epoch advances.
+    epoch::advance()?;
+    Ok(Json(HeapResponse {
+        allocated_bytes: stats::allocated::read()?,
+        active_bytes: stats::active::read()?,
+        resident_bytes: stats::resident::read()?,
+        mapped_bytes: stats::mapped::read()?,
+        retained_bytes: stats::retained::read()?,
+    }))
 }
 
 // Lists all available instances, as well as the default instance
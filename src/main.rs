@@ -1,16 +1,27 @@
 //! STAR Randomness web service
 
-use axum::{routing::get, routing::post, Router};
+use axum::{extract::DefaultBodyLimit, middleware, routing::get, routing::post, Router};
 use axum_prometheus::PrometheusMetricLayer;
 use axum_prometheus::metrics_exporter_prometheus::PrometheusHandle;
 use calendar_duration::CalendarDuration;
-use clap::Parser;
+use clap::{Parser, ValueEnum};
 use rlimit::Resource;
-use state::{OPRFServer, OPRFState};
+use state::{OPRFServer, OPRFState, ScheduleFile};
+use std::future::IntoFuture;
+use std::net::SocketAddr;
+use std::path::PathBuf;
+use std::time::Duration;
 use tikv_jemallocator::Jemalloc;
 use time::OffsetDateTime;
 use tokio::net::TcpListener;
-use tracing::{debug, info, metadata::LevelFilter};
+use tokio::signal::unix::{signal, SignalKind};
+use tokio::sync::watch;
+use tokio::task::JoinHandle;
+use tower_http::{
+    catch_panic::CatchPanicLayer, compression::CompressionLayer,
+    decompression::RequestDecompressionLayer,
+};
+use tracing::{debug, info, metadata::LevelFilter, warn};
 use tracing_subscriber::EnvFilter;
 use util::{assert_unique_names, parse_timestamp};
 
@@ -24,8 +35,17 @@ mod util;
 #[cfg(test)]
 mod tests;
 
-/// Maximum number of points acceptable in a single request
-const MAX_POINTS: usize = 1024;
+/// Default maximum number of points acceptable in a single request
+const DEFAULT_MAX_POINTS: usize = 1024;
+
+/// Format of log output
+#[derive(ValueEnum, Debug, Clone, Copy, PartialEq, Eq)]
+enum LogFormat {
+    /// Human-readable lines
+    Text,
+    /// One JSON object per event, for log pipelines
+    Json,
+}
 
 /// Command line switches
 #[derive(Parser, Debug, Clone)]
@@ -42,7 +62,13 @@ pub struct Config {
     /// Duration of each randomness epoch. This switch may be defined multiple times
     /// to set the epoch length for each respective instance, if multiple instances
     /// are defined.
-    #[arg(long = "epoch-duration", value_name = "Duration string i.e. 1mon5h2s", default_values = ["5s"])]
+    #[arg(
+        long = "epoch-duration",
+        env = "STAR_RANDSRV_EPOCH_DURATION",
+        value_name = "Duration string i.e. 1mon5h2s",
+        value_delimiter = ',',
+        default_values = ["5s"]
+    )]
     epoch_durations: Vec<CalendarDuration>,
     /// First epoch tag to make available
     #[arg(long, default_value_t = 0)]
@@ -52,53 +78,380 @@ pub struct Config {
     last_epoch: u8,
     /// Optional absolute time at which to anchor the first epoch
     /// This can be used to align the epoch sequence across different
-    /// invocations.
-    #[arg(long, value_name = "RFC 3339 timestamp", value_parser = parse_timestamp)]
+    /// invocations. If it's in the future, the server reports itself
+    /// as not ready on /readyz until the first epoch begins.
+    #[arg(
+        long,
+        env = "STAR_RANDSRV_EPOCH_BASE_TIME",
+        value_name = "RFC 3339 timestamp",
+        value_parser = parse_timestamp
+    )]
     epoch_base_time: Option<OffsetDateTime>,
+    /// Optional interval at which to rotate to a fresh OPRF key,
+    /// independent of the epoch schedule. The current epoch is
+    /// preserved across the rotation, but the public key changes.
+    /// Rotations are anchored to the epoch base time.
+    #[arg(long, value_name = "Duration string i.e. 1d")]
+    key_rotation_interval: Option<CalendarDuration>,
+    /// Optional JSON file of epoch schedule settings to apply on SIGHUP.
+    /// This may set `epochDurations`, an object mapping instance names
+    /// to duration strings, and `epochBaseTime`, an RFC 3339 timestamp.
+    /// Keys are only rotated by a reload which skips past the last
+    /// epoch, and an invalid schedule is rejected, keeping the
+    /// current one.
+    #[arg(long, value_name = "Path to JSON file")]
+    schedule_file: Option<PathBuf>,
+    /// Optional limit on the time spent decoding the points of a
+    /// single request, in milliseconds. Requests which exceed it are
+    /// abandoned with 503 Service Unavailable.
+    #[arg(long, value_name = "Milliseconds")]
+    max_parse_time_ms: Option<u64>,
+    /// Optional limit on the time spent evaluating the points of a
+    /// single request, in milliseconds. Requests which exceed it are
+    /// abandoned with 503 Service Unavailable.
+    #[arg(long, value_name = "Milliseconds")]
+    eval_timeout_ms: Option<u64>,
+    /// Optional limit on the number of randomness requests evaluated
+    /// at once. Further requests are rejected with 503 Service
+    /// Unavailable rather than queued.
+    #[arg(long)]
+    max_concurrent: Option<usize>,
+    /// Optional limit on the rate of randomness requests from each
+    /// client address. Requests beyond it are rejected with 429 Too
+    /// Many Requests.
+    #[arg(long, value_name = "Requests per second")]
+    rate_limit: Option<f64>,
+    /// Optional limit on the rate of requests to /info and the other
+    /// metadata endpoints from each client address, tracked apart
+    /// from randomness requests
+    #[arg(long, value_name = "Requests per second")]
+    info_rate_limit: Option<f64>,
+    /// Optional limit on the rate of requests to /verify from each
+    /// client address, tracked apart from randomness requests
+    #[arg(long, value_name = "Requests per second")]
+    verify_rate_limit: Option<f64>,
+    /// Number of requests each client may make at once before
+    /// `--rate-limit`, or the limit of another endpoint, applies
+    #[arg(long, default_value_t = 10)]
+    rate_burst: u32,
+    /// Number of clients `--rate-limit` tracks at once. Beyond this,
+    /// the clients least recently seen are forgotten first.
+    #[arg(long, default_value_t = 100_000)]
+    rate_limit_clients: usize,
+    /// Time after which the rate limiter forgets a client which has
+    /// made no requests, even if its bucket hasn't refilled, in
+    /// milliseconds
+    #[arg(long, default_value_t = 600_000)]
+    rate_limit_idle_ms: u64,
+    /// Interval at which idle clients are dropped from the rate
+    /// limiter, in milliseconds
+    #[arg(long, default_value_t = 60_000)]
+    rate_limit_gc_interval_ms: u64,
+    /// Optional header in which a trusted reverse proxy reports the
+    /// client address, i.e. X-Forwarded-For. The last address listed
+    /// is used for rate limiting. Don't set this unless all requests
+    /// pass through such a proxy, since clients can forge the header.
+    #[arg(long, value_name = "Header name")]
+    client_ip_header: Option<String>,
+    /// Reject randomness requests with 503 Service Unavailable if the
+    /// epoch rotation task is late advancing the epoch by more than
+    /// `--stale-loop-bound`, rather than evaluating in a stale epoch.
+    #[arg(long, default_value_t = false)]
+    fail_closed_on_stale_loop: bool,
+    /// How late the epoch rotation task may be before it's considered
+    /// stalled
+    #[arg(long, value_name = "Duration string i.e. 5s", default_value = "5s")]
+    stale_loop_bound: CalendarDuration,
+    /// Maximum number of epochs listed in each page of the schedule
+    #[arg(long, default_value_t = 256)]
+    max_schedule_entries: usize,
+    /// Maximum number of points acceptable in a single request
+    #[arg(long, env = "STAR_RANDSRV_MAX_POINTS", default_value_t = DEFAULT_MAX_POINTS)]
+    max_points: usize,
+    /// Maximum number of points proved in a single verifiable
+    /// request, which costs far more to evaluate
+    #[arg(long, default_value_t = 256)]
+    max_verifiable_points: usize,
+    /// Reject randomness requests containing unknown fields with
+    /// 400 Bad Request, rather than ignoring them
+    #[arg(long, default_value_t = false)]
+    strict_json: bool,
+    /// Maximum size of a request body, in bytes
+    #[arg(long, default_value_t = 2 * 1024 * 1024)]
+    max_request_bytes: usize,
+    /// Optional identifier for this server, used to derive its
+    /// epoch offset when `--max-epoch-jitter-ms` is set
+    #[arg(long)]
+    server_id: Option<String>,
+    /// Maximum offset to apply to the epoch schedule, in milliseconds.
+    /// Each server delays its epoch boundaries by a fixed amount up to
+    /// this limit, derived from `--server-id`, so a fleet sharing an
+    /// epoch base time doesn't rotate in lockstep.
+    #[arg(long, default_value_t = 0)]
+    max_epoch_jitter_ms: u64,
+    /// Number of evaluation outputs to cache for repeated inputs
+    /// within an epoch. Caching is disabled if zero.
+    #[arg(long, default_value_t = 0)]
+    eval_cache_size: usize,
+    /// Number of threads in the pool evaluating the points of large
+    /// requests. Defaults to the number of available CPUs.
+    #[arg(long)]
+    eval_threads: Option<usize>,
+    /// Number of recent public keys reported in /info, including
+    /// the current one
+    #[arg(long, default_value_t = 4)]
+    key_history_size: usize,
+    /// Report percentiles of recent evaluation latency in /info
+    #[arg(long, default_value_t = false)]
+    expose_latency: bool,
+    /// Optional file holding a bearer token for the admin endpoints.
+    /// The `/admin/pause` and `/admin/resume` endpoints are only
+    /// available if this is set.
+    #[arg(long, value_name = "Path to token file")]
+    admin_token_file: Option<PathBuf>,
+    /// Optional file holding a bearer token required by the randomness
+    /// endpoints, for deployments behind an authenticating gateway.
+    /// Other endpoints, including `/info`, remain public.
+    #[arg(long, value_name = "Path to token file")]
+    auth_token_file: Option<PathBuf>,
+    /// Origins allowed to make cross-origin requests from browsers,
+    /// separated by commas, or `*` to allow any origin. CORS headers
+    /// aren't sent if this is empty.
+    #[arg(long, value_name = "Origin list", value_delimiter = ',')]
+    cors_origins: Vec<String>,
+    /// Time to wait for in-flight requests to complete after
+    /// SIGTERM or SIGINT before exiting, in milliseconds
+    #[arg(long, default_value_t = 10_000)]
+    shutdown_timeout_ms: u64,
     /// Increases OS nofile limit to 65535, so the server can handle
     /// more concurrent connections.
     #[arg(long, default_value_t = false)]
     increase_nofile_limit: bool,
+    /// Format of log output
+    #[arg(long, value_enum, default_value_t = LogFormat::Text)]
+    log_format: LogFormat,
+    /// Minimum level of events to log: error, warn, info, debug or
+    /// trace. Directives in `RUST_LOG` take precedence.
+    #[arg(long, default_value = "info")]
+    log_level: LevelFilter,
     /// Enable prometheus metric reporting and listen on specified address.
     #[arg(long)]
     prometheus_listen: Option<String>,
+    /// Enable profiling endpoints and listen on specified address.
+    /// Profiles reveal details of the server's operation, so this
+    /// should only be reachable by operators.
+    #[arg(long)]
+    pprof_listen: Option<String>,
 }
 
 /// Initialize an axum::Router for our web service
 /// Having this as a separate function makes testing easier.
 fn app(oprf_state: OPRFState) -> Router {
-    Router::new()
-        // Friendly default route to identify the site
-        .route("/", get(|| async { "STAR randomness server\n" }))
-        // Endpoints for all instances
+    let max_request_bytes = oprf_state.max_request_bytes;
+    // Randomness endpoints, subject to authentication, if enabled,
+    // and the per-client rate limit
+    let randomness = Router::new()
         .route(
             "/instances/:instance/randomness",
             post(handler::specific_instance_randomness),
         )
+        .route(
+            "/instances/:instance/randomness/raw",
+            post(handler::specific_instance_raw_randomness),
+        )
+        .route(
+            "/instances/:instance/randomness/multi",
+            post(handler::specific_instance_multi_randomness),
+        )
+        .route("/randomness", post(handler::default_instance_randomness))
+        .route(
+            "/randomness/raw",
+            post(handler::default_instance_raw_randomness),
+        )
+        .route(
+            "/randomness/multi",
+            post(handler::default_instance_multi_randomness),
+        )
+        .route_layer(middleware::from_fn_with_state(
+            oprf_state.clone(),
+            handler::rate_limit,
+        ))
+        .route_layer(middleware::from_fn_with_state(
+            oprf_state.clone(),
+            handler::authenticate,
+        ))
+        .route_layer(middleware::from_fn_with_state(
+            oprf_state.clone(),
+            handler::count_requests,
+        ));
+    // Metadata endpoints, subject to their own rate limit
+    let metadata = Router::new()
+        // Endpoints for all instances
         .route(
             "/instances/:instance/info",
             get(handler::specific_instance_info),
         )
+        .route(
+            "/instances/:instance/epoch-span",
+            get(handler::specific_instance_epoch_span),
+        )
+        .route(
+            "/instances/:instance/schedule",
+            get(handler::specific_instance_schedule),
+        )
+        .route(
+            "/instances/:instance/status",
+            get(handler::specific_instance_status),
+        )
         .route("/instances", get(handler::list_instances))
         // Endpoints for default instance
-        .route("/randomness", post(handler::default_instance_randomness))
         .route("/info", get(handler::default_instance_info))
+        .route("/epoch-span", get(handler::default_instance_epoch_span))
+        .route("/schedule", get(handler::default_instance_schedule))
+        .route("/status", get(handler::default_instance_status))
+        .route_layer(middleware::from_fn_with_state(
+            oprf_state.clone(),
+            handler::rate_limit_info,
+        ));
+    // Proof verification endpoints, subject to their own rate limit
+    let verify = Router::new()
+        .route(
+            "/instances/:instance/verify",
+            post(handler::specific_instance_verify),
+        )
+        .route(
+            "/instances/:instance/verify/multi",
+            post(handler::specific_instance_multi_verify),
+        )
+        .route("/verify", post(handler::default_instance_verify))
+        .route("/verify/multi", post(handler::default_instance_multi_verify))
+        .route_layer(middleware::from_fn_with_state(
+            oprf_state.clone(),
+            handler::rate_limit_verify,
+        ));
+    let mut router = Router::new();
+    // Operator endpoints, only if a token is configured
+    if oprf_state.admin_token.is_some() {
+        router = router
+            .route("/admin/pause", post(handler::pause))
+            .route("/admin/resume", post(handler::resume));
+    }
+    router
+        // Friendly default route to identify the site
+        .route("/", get(|| async { "STAR randomness server\n" }))
+        .route("/healthz", get(handler::health))
+        .route("/readyz", get(handler::readiness))
+        .route("/version", get(handler::version))
+        .merge(randomness)
+        .merge(metadata)
+        .merge(verify)
+        // Answer CORS preflight requests before routing them,
+        // and mark responses to allowed origins.
+        .layer(middleware::from_fn_with_state(
+            oprf_state.clone(),
+            handler::cors,
+        ))
         // Attach shared state
         .with_state(oprf_state)
+        .layer(DefaultBodyLimit::max(max_request_bytes))
+        // Accept gzipped requests and compress responses on request.
+        // The body limit applies to the decompressed request.
+        .layer(RequestDecompressionLayer::new())
+        .layer(CompressionLayer::new())
+        // Turn panics into 500 responses, within the request's span.
+        .layer(CatchPanicLayer::custom(handler::panic_response))
         // Logging must come after active routes
         .layer(tower_http::trace::TraceLayer::new_for_http())
 }
 
-fn start_prometheus_server(metrics_handle: PrometheusHandle, addr: String) {
+/// Signal of server shutdown, shared by all the long-running tasks
+/// The value becomes `true` once shutdown begins.
+type ShutdownToken = watch::Receiver<bool>;
+
+/// Wait for shutdown to begin
+/// Dropping the sender also counts, so tasks never outlive it.
+async fn shutdown_started(mut token: ShutdownToken) {
+    let _ = token.wait_for(|&shutdown| shutdown).await;
+}
+
+fn start_prometheus_server(
+    metrics_handle: PrometheusHandle,
+    addr: String,
+    token: ShutdownToken,
+) -> JoinHandle<()> {
     tokio::spawn(async move {
         let metrics_app =
             Router::new().route("/metrics", get(|| async move { metrics_handle.render() }));
         info!("Metrics server listening on {}", addr);
         let listener = TcpListener::bind(addr).await.unwrap();
         axum::serve(listener, metrics_app)
+            .with_graceful_shutdown(shutdown_started(token))
             .await
             .unwrap();
-    });
+    })
+}
+
+/// Initialize an axum::Router for the profiling endpoints
+/// These are served separately from the main app, so they're
+/// never exposed alongside the public endpoints.
+fn pprof_app() -> Router {
+    Router::new()
+        .route("/debug/pprof/profile", get(handler::cpu_profile))
+        .route("/debug/pprof/heap", get(handler::heap_stats))
+}
+
+fn start_pprof_server(addr: String, token: ShutdownToken) -> JoinHandle<()> {
+    tokio::spawn(async move {
+        info!("Profiling server listening on {}", addr);
+        let listener = TcpListener::bind(addr).await.unwrap();
+        axum::serve(listener, pprof_app())
+            .with_graceful_shutdown(shutdown_started(token))
+            .await
+            .unwrap();
+    })
+}
+
+/// Reload the epoch schedule from `path` whenever we receive SIGHUP,
+/// until shutdown begins
+fn start_schedule_reload_handler(
+    oprf_state: OPRFState,
+    mut config: Config,
+    path: PathBuf,
+    token: ShutdownToken,
+) -> JoinHandle<()> {
+    tokio::spawn(async move {
+        let mut hangup =
+            signal(SignalKind::hangup()).expect("should be able to listen for SIGHUP");
+        loop {
+            tokio::select! {
+                Some(_) = hangup.recv() => {}
+                _ = shutdown_started(token.clone()) => break,
+            }
+            info!("reloading epoch schedule from {}", path.display());
+            let result = ScheduleFile::load(&path)
+                .and_then(|schedule| schedule.apply(&config))
+                .and_then(|new_config| {
+                    oprf_state.reload_schedule(&new_config)?;
+                    Ok(new_config)
+                });
+            match result {
+                Ok(new_config) => config = new_config,
+                Err(e) => warn!("keeping current epoch schedule: {e}"),
+            }
+        }
+    })
+}
+
+/// Wait for a request to terminate the server
+async fn shutdown_signal() {
+    let mut terminate =
+        signal(SignalKind::terminate()).expect("should be able to listen for SIGTERM");
+    let mut interrupt =
+        signal(SignalKind::interrupt()).expect("should be able to listen for SIGINT");
+    tokio::select! {
+        _ = terminate.recv() => info!("received SIGTERM"),
+        _ = interrupt.recv() => info!("received SIGINT"),
+    }
 }
 
 fn increase_nofile_limit() {
@@ -117,20 +470,23 @@ fn increase_nofile_limit() {
 
 #[tokio::main]
 async fn main() {
+    // Command line switches
+    let config = Config::parse();
+
     // Start logging
     // The default subscriber respects filter directives like `RUST_LOG=info`
-    tracing_subscriber::fmt()
-        .with_env_filter(
-            EnvFilter::builder()
-                .with_default_directive(LevelFilter::INFO.into())
-                .from_env()
-                .unwrap(),
-        )
-        .init();
+    let filter = EnvFilter::builder()
+        .with_default_directive(config.log_level.into())
+        .from_env()
+        .unwrap();
+    match config.log_format {
+        LogFormat::Text => tracing_subscriber::fmt().with_env_filter(filter).init(),
+        LogFormat::Json => tracing_subscriber::fmt()
+            .json()
+            .with_env_filter(filter)
+            .init(),
+    }
     info!("STARing up!");
-
-    // Command line switches
-    let config = Config::parse();
     debug!(?config, "config parsed");
 
     if config.increase_nofile_limit {
@@ -142,6 +498,54 @@ async fn main() {
         !config.epoch_durations.iter().any(|d| d.is_zero()),
         "all epoch lengths must be non-zero"
     );
+    assert!(
+        !config.key_rotation_interval.is_some_and(|d| d.is_zero()),
+        "key rotation interval must be non-zero"
+    );
+    assert!(config.max_points > 0, "max points must be non-zero");
+    assert!(
+        config.max_verifiable_points > 0,
+        "max verifiable points must be non-zero"
+    );
+    assert!(
+        config.eval_threads != Some(0),
+        "evaluation thread count must be non-zero"
+    );
+    assert!(
+        config.max_concurrent != Some(0),
+        "max concurrent requests must be non-zero"
+    );
+    for rate_limit in [
+        config.rate_limit,
+        config.info_rate_limit,
+        config.verify_rate_limit,
+    ] {
+        assert!(
+            !rate_limit.is_some_and(|rate| !(rate > 0.0 && rate.is_finite())),
+            "rate limit must be positive"
+        );
+    }
+    assert!(config.rate_burst > 0, "rate burst must be non-zero");
+    assert!(
+        config.rate_limit_clients > 0,
+        "rate limit client count must be non-zero"
+    );
+    assert!(
+        config.rate_limit_idle_ms > 0,
+        "rate limit idle time must be non-zero"
+    );
+    assert!(
+        config.rate_limit_gc_interval_ms > 0,
+        "rate limit cleanup interval must be non-zero"
+    );
+    assert!(
+        config.max_schedule_entries > 0,
+        "max schedule entries must be non-zero"
+    );
+    assert!(
+        config.key_history_size > 0,
+        "key history size must be non-zero"
+    );
     assert!(
         !config.instance_names.is_empty(),
         "at least one instance name must be defined"
@@ -151,14 +555,31 @@ async fn main() {
         "instance-name switch count must match epoch-seconds switch count"
     );
 
+    // Every long-running task stops once this is set.
+    let (shutdown, token) = watch::channel(false);
+    let mut tasks = Vec::new();
     let metric_layer = config.prometheus_listen.as_ref().map(|listen| {
         let (layer, handle) = PrometheusMetricLayer::pair();
-        start_prometheus_server(handle, listen.clone());
+        tasks.push(start_prometheus_server(handle, listen.clone(), token.clone()));
         layer
     });
+    if let Some(listen) = &config.pprof_listen {
+        tasks.push(start_pprof_server(listen.clone(), token.clone()));
+    }
 
     let oprf_state = OPRFServer::new(&config);
-    oprf_state.start_background_tasks(&config);
+    oprf_state
+        .start_background_tasks(&config)
+        .expect("should be able to start background tasks");
+    let background_state = oprf_state.clone();
+    if let Some(path) = &config.schedule_file {
+        tasks.push(start_schedule_reload_handler(
+            oprf_state.clone(),
+            config.clone(),
+            path.clone(),
+            token.clone(),
+        ));
+    }
 
     // Set up routes and middleware
     info!("initializing routes...");
@@ -170,5 +591,35 @@ async fn main() {
     // Start the server
     info!("Listening on {}", &config.listen);
     let listener = TcpListener::bind(&config.listen).await.unwrap();
-    axum::serve(listener, app).await.unwrap();
+    // Stop accepting connections on a termination signal, and
+    // give in-flight requests a bounded time to complete.
+    // Record peer addresses for the rate limiter.
+    let app = app.into_make_service_with_connect_info::<SocketAddr>();
+    let server =
+        axum::serve(listener, app).with_graceful_shutdown(shutdown_started(token.clone()));
+    let mut server = tokio::spawn(server.into_future());
+    tokio::select! {
+        result = &mut server => result.unwrap().unwrap(),
+        _ = shutdown_signal() => {
+            let _ = shutdown.send(true);
+            let timeout = Duration::from_millis(config.shutdown_timeout_ms);
+            info!("shutting down, waiting up to {timeout:?} for requests to complete");
+            let deadline = tokio::time::Instant::now() + timeout;
+            match tokio::time::timeout_at(deadline, &mut server).await {
+                Ok(result) => result.unwrap().unwrap(),
+                Err(_) => {
+                    warn!("timed out waiting for requests, dropping connections");
+                    server.abort();
+                }
+            }
+            // The other listeners drain within the same time limit.
+            for mut task in tasks {
+                if tokio::time::timeout_at(deadline, &mut task).await.is_err() {
+                    task.abort();
+                }
+            }
+        }
+    }
+    background_state.stop_background_tasks();
+    info!("shutdown complete");
 }
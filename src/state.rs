@@ -2,39 +2,531 @@
 //! Epoch and key state and its management
 
 use calendar_duration::CalendarDuration;
+use metrics::counter;
+use rayon::prelude::*;
+use serde::Deserialize;
+use sha2::{Digest, Sha256};
 use std::{
-    collections::HashMap,
-    sync::{Arc, RwLock},
+    collections::{BTreeMap, HashMap, HashSet, VecDeque},
+    net::{IpAddr, Ipv6Addr},
+    ops::RangeInclusive,
+    path::Path,
+    sync::{atomic::AtomicBool, Arc, Mutex, MutexGuard, RwLock},
+    time::{Duration, Instant},
 };
 use time::{format_description::well_known::Rfc3339, OffsetDateTime};
-use tracing::{info, instrument};
+use tokio::sync::Semaphore;
+use tokio::task::AbortHandle;
+use tracing::{debug, error, info, instrument, warn};
 
+use crate::util::parse_timestamp;
 use crate::Config;
 use ppoprf::ppoprf;
 
+/// Number of recent evaluations used for latency percentiles
+const LATENCY_WINDOW: usize = 1024;
+
+/// Minimum number of points evaluated by each thread of a batch,
+/// below which handing them to the pool costs more than it saves
+const PARALLEL_EVAL_CHUNK: usize = 64;
+
+/// Number of attempts at generating the next key before leaving it
+/// to be generated at rotation
+const KEY_GENERATION_ATTEMPTS: u32 = 3;
+
+/// Delay between attempts at generating the next key
+const KEY_GENERATION_RETRY_DELAY: Duration = Duration::from_secs(1);
+
+/// Epoch schedule of an OPRF instance
+#[derive(Clone, Copy, Debug)]
+pub struct EpochSchedule {
+    /// Start of the first epoch
+    pub base_time: OffsetDateTime,
+    /// Duration of each epoch
+    pub epoch_duration: CalendarDuration,
+}
+
+impl EpochSchedule {
+    /// List the epoch tags in effect over the time range `from..=to`
+    ///
+    /// Tags repeat once the sequence wraps around, since each
+    /// pass through the sequence uses a fresh key. Returns `None`
+    /// if the range starts before the base time or covers more
+    /// than `limit` epochs.
+    pub fn epochs_between(
+        &self,
+        epochs: RangeInclusive<u8>,
+        from: OffsetDateTime,
+        to: OffsetDateTime,
+        limit: usize,
+    ) -> Option<Vec<u8>> {
+        if from < self.base_time {
+            return None;
+        }
+        let StartingEpochInfo {
+            mut elapsed_epoch_count,
+            mut next_rotation,
+            ..
+        } = StartingEpochInfo::calculate_at(self.base_time, self.epoch_duration, from);
+        // The `epochs` range is `u8`, so the length can be no more
+        // than `u8::MAX + 1`, making it safe to truncate the modulo.
+        let tag = |count: usize| epochs.start() + (count % epochs.len()) as u8;
+        let mut span = vec![tag(elapsed_epoch_count)];
+        while next_rotation < to {
+            if span.len() == limit {
+                return None;
+            }
+            elapsed_epoch_count += 1;
+            next_rotation = next_rotation + self.epoch_duration;
+            span.push(tag(elapsed_epoch_count));
+        }
+        Some(span)
+    }
+
+    /// Locate the epoch tag in effect at time `at`
+    ///
+    /// Returns the tag along with the start and end of its epoch,
+    /// or `None` if `at` is before the base time.
+    pub fn epoch_at(
+        &self,
+        epochs: RangeInclusive<u8>,
+        at: OffsetDateTime,
+    ) -> Option<(u8, OffsetDateTime, OffsetDateTime)> {
+        if at < self.base_time {
+            return None;
+        }
+        let StartingEpochInfo {
+            elapsed_epoch_count,
+            epoch_start,
+            next_rotation,
+        } = StartingEpochInfo::calculate_at(self.base_time, self.epoch_duration, at);
+        // As above, the modulo is safe to truncate.
+        let tag = epochs.start() + (elapsed_epoch_count % epochs.len()) as u8;
+        Some((tag, epoch_start, next_rotation))
+    }
+}
+
+/// Bounded cache of evaluation outputs for the current epoch
+///
+/// Outputs are deterministic within an epoch, so repeated inputs can
+/// be served without evaluating again. The least recently used entry
+/// is evicted when full. Entries must be dropped whenever the epoch
+/// or key changes.
+pub struct EvalCache {
+    capacity: usize,
+    /// Counter ordering accesses by recency
+    tick: u64,
+    /// Output and last access tick for each compressed input
+    entries: HashMap<[u8; ppoprf::COMPRESSED_POINT_LEN], (ppoprf::Point, u64)>,
+    /// Compressed inputs by last access tick, oldest first
+    order: BTreeMap<u64, [u8; ppoprf::COMPRESSED_POINT_LEN]>,
+}
+
+impl EvalCache {
+    /// Create an empty cache holding up to `capacity` outputs
+    pub fn new(capacity: usize) -> Self {
+        EvalCache {
+            capacity,
+            tick: 0,
+            entries: HashMap::with_capacity(capacity),
+            order: BTreeMap::new(),
+        }
+    }
+
+    /// Lock a shared cache
+    /// A poisoned cache only held outputs, so we can reuse it.
+    pub fn lock(cache: &Mutex<EvalCache>) -> MutexGuard<'_, EvalCache> {
+        cache.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Look up the output for an input, marking it recently used
+    pub fn get(&mut self, input: &ppoprf::Point) -> Option<ppoprf::Point> {
+        self.tick += 1;
+        let key = *input.as_bytes();
+        let (output, tick) = self.entries.get_mut(&key)?;
+        self.order.remove(tick);
+        self.order.insert(self.tick, key);
+        *tick = self.tick;
+        Some(*output)
+    }
+
+    /// Store the output for an input, evicting the least recently
+    /// used entry if the cache is full
+    pub fn insert(&mut self, input: ppoprf::Point, output: ppoprf::Point) {
+        self.tick += 1;
+        let key = *input.as_bytes();
+        if let Some((_, tick)) = self.entries.insert(key, (output, self.tick)) {
+            self.order.remove(&tick);
+        } else if self.entries.len() > self.capacity {
+            if let Some((_, oldest)) = self.order.pop_first() {
+                self.entries.remove(&oldest);
+            }
+        }
+        self.order.insert(self.tick, key);
+    }
+
+    /// Number of outputs held
+    pub fn len(&self) -> usize {
+        self.entries.len()
+    }
+
+    /// Drop all entries
+    pub fn clear(&mut self) {
+        self.entries.clear();
+        self.order.clear();
+    }
+}
+
+/// Public key retained in an instance's key history
+pub struct KeyRecord {
+    /// Number of keys the instance generated before this one
+    pub generation: u64,
+    /// Epoch in which the key took effect
+    pub epoch: u8,
+    pub public_key: ppoprf::ServerPublicKey,
+}
+
 /// Internal state of an OPRF instance
 pub struct OPRFInstance {
     /// oprf implementation
     pub server: ppoprf::Server,
+    /// oprf implementation to take over at the next key rotation,
+    /// generated in advance so its public key can be published and
+    /// the rotation doesn't stall requests. `None` while its
+    /// replacement is generated after a rotation.
+    pub next_server: Option<ppoprf::Server>,
     /// currently-valid randomness epoch
     pub epoch: u8,
+    /// first epoch of each key
+    pub first_epoch: u8,
+    /// final epoch before the key is rotated
+    pub last_epoch: u8,
+    /// epochs punctured from the current key
+    pub punctured: HashSet<u8>,
     /// RFC 3339 timestamp of the next epoch rotation
     pub next_epoch_time: Option<String>,
+    /// RFC 3339 timestamp at which the current epoch began
+    pub epoch_start_time: Option<String>,
+    /// Time at which the current epoch began, once the epoch
+    /// rotation task has started
+    pub epoch_start: Option<OffsetDateTime>,
+    /// Time by which the epoch rotation task should next advance
+    /// the epoch, once it has started
+    pub epoch_deadline: Option<OffsetDateTime>,
+    /// RFC 3339 timestamp of the next scheduled key rotation,
+    /// if periodic key rotation is enabled
+    pub next_key_rotation_time: Option<String>,
+    /// Time of the next scheduled key rotation, if periodic
+    /// key rotation is enabled
+    pub key_rotation_deadline: Option<OffsetDateTime>,
+    /// Schedule followed by the epoch rotation task,
+    /// once it has started
+    pub schedule: Option<EpochSchedule>,
+    /// Cache of outputs for the current epoch, if enabled
+    pub eval_cache: Option<Mutex<EvalCache>>,
+    /// Pool evaluating large batches, shared by all instances,
+    /// or `None` to evaluate on the calling thread
+    pub eval_pool: Option<Arc<rayon::ThreadPool>>,
+    /// Recent public keys, oldest first. The last entry is the
+    /// current key.
+    pub key_history: VecDeque<KeyRecord>,
+    /// Hex-encoded SHA-256 digest of the serialized current
+    /// public key
+    pub public_key_fingerprint: String,
 }
 
 impl OPRFInstance {
-    /// Initialize a new OPRFServer state with the given configuration
-    pub fn new(config: &Config) -> Result<Self, ppoprf::PPRFError> {
-        // ppoprf wants a vector, so generate one from our range.
-        let epochs: Vec<u8> = (config.first_epoch..=config.last_epoch).collect();
-        let epoch = epochs[0];
-        let server = ppoprf::Server::new(epochs)?;
-        Ok(OPRFInstance {
+    /// Initialize a new OPRFServer state with the given configuration,
+    /// evaluating large batches on `eval_pool`
+    pub fn new(
+        config: &Config,
+        eval_pool: Option<Arc<rayon::ThreadPool>>,
+    ) -> Result<Self, ppoprf::PPRFError> {
+        let server = generate_key(config)?;
+        let next_server = Some(generate_key(config)?);
+        let mut instance = OPRFInstance {
             server,
-            epoch,
+            next_server,
+            epoch: config.first_epoch,
+            first_epoch: config.first_epoch,
+            last_epoch: config.last_epoch,
+            punctured: HashSet::new(),
             next_epoch_time: None,
+            epoch_start_time: None,
+            epoch_start: None,
+            epoch_deadline: None,
+            next_key_rotation_time: None,
+            key_rotation_deadline: None,
+            schedule: None,
+            eval_cache: (config.eval_cache_size > 0)
+                .then(|| Mutex::new(EvalCache::new(config.eval_cache_size))),
+            eval_pool,
+            key_history: VecDeque::with_capacity(config.key_history_size),
+            public_key_fingerprint: String::new(),
+        };
+        instance.record_key(config)?;
+        Ok(instance)
+    }
+
+    /// Add the current key to the key history, discarding the
+    /// oldest entry if the history is full, and update its fingerprint
+    fn record_key(&mut self, config: &Config) -> Result<(), ppoprf::PPRFError> {
+        let public_key = self.server.get_public_key();
+        let digest = Sha256::digest(public_key.serialize_to_bincode()?);
+        self.public_key_fingerprint = digest.iter().map(|byte| format!("{byte:02x}")).collect();
+        let generation = self.key_history.back().map_or(0, |key| key.generation + 1);
+        if self.key_history.len() == config.key_history_size {
+            self.key_history.pop_front();
+        }
+        self.key_history.push_back(KeyRecord {
+            generation,
+            epoch: self.epoch,
+            public_key,
+        });
+        Ok(())
+    }
+
+    /// Public key of a generation still held in the key history
+    pub fn public_key_for(&self, generation: u64) -> Option<&ppoprf::ServerPublicKey> {
+        self.key_history
+            .iter()
+            .find(|key| key.generation == generation)
+            .map(|key| &key.public_key)
+    }
+
+    /// Puncture an epoch so it can no longer be used with this key
+    pub fn puncture(&mut self, epoch: u8) -> Result<(), ppoprf::PPRFError> {
+        if let Err(e) = self.server.puncture(epoch) {
+            counter!("puncture_failures_total").increment(1);
+            return Err(e);
+        }
+        self.punctured.insert(epoch);
+        self.clear_eval_cache();
+        Ok(())
+    }
+
+    /// Evaluate a batch of points in an epoch, failing on the
+    /// first point which can't be evaluated
+    /// See `eval_each`.
+    pub fn eval(
+        &self,
+        points: &[ppoprf::Point],
+        epoch: u8,
+        verifiable: bool,
+        deadline: Option<Instant>,
+    ) -> Result<Vec<ppoprf::Evaluation>, EvalError> {
+        self.eval_each(points, epoch, verifiable, deadline)?
+            .into_iter()
+            .enumerate()
+            .map(|(index, result)| result.map_err(|source| EvalError::Failed { index, source }))
+            .collect()
+    }
+
+    /// Evaluate a batch of points in an epoch, reporting each
+    /// failure in place
+    ///
+    /// Points repeated within the batch are evaluated once, and
+    /// outputs for the current epoch are reused from the evaluation
+    /// cache, if enabled. Only outputs are reused, so verifiable
+    /// evaluations always run afresh to produce their proofs.
+    ///
+    /// The deadline is checked before evaluating each point, so
+    /// the batch is abandoned with `EvalError::TimedOut` within
+    /// one point's evaluation of passing it.
+    pub fn eval_each(
+        &self,
+        points: &[ppoprf::Point],
+        epoch: u8,
+        verifiable: bool,
+        deadline: Option<Instant>,
+    ) -> Result<Vec<Result<ppoprf::Evaluation, ppoprf::PPRFError>>, EvalError> {
+        let cache = self.eval_cache.as_ref().filter(|_| epoch == self.epoch && !verifiable);
+        let mut seen = HashSet::new();
+        let mut outputs = HashMap::new();
+        let mut results: Vec<Option<Result<ppoprf::Evaluation, ppoprf::PPRFError>>> =
+            (0..points.len()).map(|_| None).collect();
+        let mut misses = Vec::new();
+        let mut repeats = Vec::new();
+        // Look up the whole batch under a single lock, and release
+        // it while evaluating the misses.
+        let mut lookups = cache.map(EvalCache::lock);
+        let mut hits = 0;
+        for (index, point) in points.iter().enumerate() {
+            if !verifiable {
+                if !seen.insert(point.as_bytes()) {
+                    repeats.push(index);
+                    continue;
+                }
+                let output = lookups.as_mut().and_then(|cache| cache.get(point));
+                if let Some(output) = output {
+                    hits += 1;
+                    outputs.insert(point.as_bytes(), output);
+                    results[index] = Some(Ok(ppoprf::Evaluation {
+                        output,
+                        proof: None,
+                    }));
+                    continue;
+                }
+            }
+            misses.push(index);
+        }
+        if lookups.take().is_some() {
+            counter!("eval_cache_hits_total").increment(hits);
+            counter!("eval_cache_misses_total").increment(misses.len() as u64);
+        }
+        let uncached: Vec<_> = misses.iter().map(|&index| points[index]).collect();
+        let evaluations = self
+            .eval_parallel(&uncached, epoch, verifiable, deadline)
+            .ok_or(EvalError::TimedOut)?;
+        let mut inserts = cache.map(EvalCache::lock);
+        for (index, evaluation) in misses.into_iter().zip(evaluations) {
+            if let Ok(evaluation) = &evaluation {
+                if let Some(cache) = inserts.as_mut() {
+                    cache.insert(points[index], evaluation.output);
+                }
+                outputs.insert(points[index].as_bytes(), evaluation.output);
+            }
+            results[index] = Some(evaluation);
+        }
+        drop(inserts);
+        for index in repeats {
+            // Repeats of a point which failed get their own error.
+            let result = match outputs.get(points[index].as_bytes()) {
+                Some(&output) => Ok(ppoprf::Evaluation {
+                    output,
+                    proof: None,
+                }),
+                None => self.server.eval(&points[index], epoch, verifiable),
+            };
+            results[index] = Some(result);
+        }
+        Ok(results.into_iter().flatten().collect())
+    }
+
+    /// Evaluate a batch of points, spreading large batches across
+    /// the evaluation pool
+    /// Results are in the same order as the points, or `None` if
+    /// the deadline passed first. The instance is only read, so this
+    /// can run under a shared lock. A panic in the pool carries on
+    /// to the caller.
+    pub fn eval_parallel(
+        &self,
+        points: &[ppoprf::Point],
+        epoch: u8,
+        verifiable: bool,
+        deadline: Option<Instant>,
+    ) -> Option<Vec<Result<ppoprf::Evaluation, ppoprf::PPRFError>>> {
+        let eval = |point| {
+            if deadline.is_some_and(|deadline| Instant::now() >= deadline) {
+                return None;
+            }
+            Some(self.server.eval(point, epoch, verifiable))
+        };
+        match &self.eval_pool {
+            Some(pool) if points.len() > PARALLEL_EVAL_CHUNK => pool.install(|| {
+                points
+                    .par_iter()
+                    .with_min_len(PARALLEL_EVAL_CHUNK)
+                    .map(eval)
+                    .collect()
+            }),
+            _ => points.iter().map(eval).collect(),
+        }
+    }
+
+    /// Drop any cached outputs, after the epoch or key changes
+    fn clear_eval_cache(&mut self) {
+        if let Some(cache) = &mut self.eval_cache {
+            // A poisoned cache only held outputs, so we can reuse it.
+            cache.get_mut().unwrap_or_else(|e| e.into_inner()).clear();
+        }
+    }
+
+    /// Puncture the current epoch and advance to the next one
+    /// Rotates to a fresh key once all epochs are exhausted.
+    pub fn advance_epoch(&mut self, config: &Config) -> Result<(), ppoprf::PPRFError> {
+        // Puncture the current epoch so it can no longer be used.
+        let old_epoch = self.epoch;
+        self.puncture(old_epoch)?;
+
+        // Advance to the next epoch, checking for overflow
+        // and out-of-range.
+        let epochs = config.first_epoch..=config.last_epoch;
+        let new_epoch = old_epoch.checked_add(1);
+        if new_epoch.filter(|e| epochs.contains(e)).is_some() {
+            // Server is already initialized for this one.
+            self.epoch = new_epoch.unwrap();
+        } else {
+            info!("Epochs exhausted! Rotating OPRF key");
+            // Puncture should mean we can't violate privacy through
+            // further evaluations, but we still want to drop the
+            // inner state with its private key.
+            self.epoch = config.first_epoch;
+            self.rotate_key(config)?;
+        }
+        Ok(())
+    }
+
+    /// Replace the key with the pre-generated next one
+    /// A fresh key is only generated here if the next one hasn't
+    /// been replaced since the last rotation; see `prepare_next_key`.
+    /// Epochs before the current one are punctured in the new
+    /// key, so the epoch schedule is unaffected by the rotation.
+    pub fn rotate_key(&mut self, config: &Config) -> Result<(), ppoprf::PPRFError> {
+        let mut server = match self.next_server.take() {
+            Some(server) => server,
+            None => generate_key(config)?,
+        };
+        for epoch in config.first_epoch..self.epoch {
+            server.puncture(epoch)?;
+        }
+        self.server = server;
+        self.punctured = (config.first_epoch..self.epoch).collect();
+        self.clear_eval_cache();
+        self.record_key(config)?;
+        counter!("key_rotations_total").increment(1);
+        Ok(())
+    }
+
+    /// Time at which the current key will be replaced
+    /// This is when the epochs are exhausted, or the next periodic
+    /// key rotation if that's sooner. Returns `None` until the
+    /// epoch rotation task has started.
+    pub fn next_key_change(&self) -> Option<OffsetDateTime> {
+        let schedule = self.schedule?;
+        let mut exhausted = self.epoch_deadline?;
+        for _ in self.epoch..self.last_epoch {
+            exhausted = exhausted + schedule.epoch_duration;
+        }
+        Some(match self.key_rotation_deadline {
+            Some(rotation) if rotation < exhausted => rotation,
+            _ => exhausted,
         })
     }
+
+    /// Public key in effect for the next epoch
+    /// This is the current key, unless the key is due to change
+    /// before the next epoch begins. Returns `None` if the next key
+    /// is still being generated.
+    pub fn next_public_key(&self) -> Option<ppoprf::ServerPublicKey> {
+        let changes = match (self.next_key_change(), self.epoch_deadline) {
+            (Some(change), Some(deadline)) => change <= deadline,
+            // Without a schedule, only exhausting the epochs counts.
+            _ => self.epoch == self.last_epoch,
+        };
+        if changes {
+            self.next_server.as_ref().map(|server| server.get_public_key())
+        } else {
+            Some(self.server.get_public_key())
+        }
+    }
+
+    /// Whether the epoch rotation task is more than `bound` late
+    /// advancing the epoch at time `now`
+    pub fn is_stale(&self, bound: CalendarDuration, now: OffsetDateTime) -> bool {
+        self.epoch_deadline
+            .is_some_and(|deadline| now > deadline + bound)
+    }
 }
 
 /// Container for OPRF instances
@@ -43,6 +535,328 @@ pub struct OPRFServer {
     pub instances: HashMap<String, RwLock<OPRFInstance>>,
     /// The name of the default instance
     pub default_instance: String,
+    /// Handles for the running epoch rotation tasks,
+    /// keyed by instance name
+    epoch_tasks: Mutex<HashMap<String, AbortHandle>>,
+    /// Handles for the running key rotation tasks,
+    /// keyed by instance name
+    key_rotation_tasks: Mutex<HashMap<String, AbortHandle>>,
+    /// Handle for the running rate limiter cleanup task
+    rate_limit_gc_task: Mutex<Option<AbortHandle>>,
+    /// Interval at which idle clients are dropped from the rate limiter
+    rate_limit_gc_interval: Duration,
+    /// Limit on the time spent decoding points for each request
+    pub max_parse_time: Option<Duration>,
+    /// Limit on the time spent evaluating each request
+    pub eval_timeout: Option<Duration>,
+    /// Permits for concurrent evaluations, if limited
+    pub eval_permits: Option<Arc<Semaphore>>,
+    /// Limits on each client's rate of randomness requests, if enabled
+    pub rate_limiter: Option<RateLimiter>,
+    /// Limits on each client's rate of requests to the info and
+    /// other metadata endpoints, if enabled
+    pub info_rate_limiter: Option<RateLimiter>,
+    /// Limits on each client's rate of verify requests, if enabled
+    pub verify_rate_limiter: Option<RateLimiter>,
+    /// Header in which a trusted proxy reports client addresses
+    pub client_ip_header: Option<String>,
+    /// Maximum size of a request body, in bytes
+    pub max_request_bytes: usize,
+    /// Maximum number of points acceptable in a single request
+    pub max_points: usize,
+    /// Maximum number of points proved in a single request
+    pub max_verifiable_points: usize,
+    /// Whether to reject requests with unknown fields
+    pub strict_json: bool,
+    /// How late epoch rotation may be before randomness requests
+    /// are refused, if failing closed on a stalled rotation task
+    pub stale_loop_bound: Option<CalendarDuration>,
+    /// Maximum number of entries in a page of the schedule
+    pub max_schedule_entries: usize,
+    /// Delay applied to the epoch schedule of every instance
+    pub epoch_offset: Duration,
+    /// Recent evaluation durations, if reported by the info endpoint
+    pub latency: Option<Mutex<LatencyWindow>>,
+    /// Bearer token required by the admin endpoints, if enabled
+    pub admin_token: Option<String>,
+    /// Bearer token required by the randomness endpoints, if enabled
+    pub auth_token: Option<String>,
+    /// Origins allowed to make cross-origin requests, or `*` for any
+    pub cors_origins: Vec<String>,
+    /// Whether serving randomness has been paused by an operator
+    pub paused: AtomicBool,
+    /// Source of the current time for epoch calculations
+    clock: Clock,
+}
+
+/// Source of the current time
+/// The system clock is used outside tests.
+pub type Clock = Arc<dyn Fn() -> OffsetDateTime + Send + Sync>;
+
+/// Token bucket rate limits on the requests of each client
+///
+/// Every client starts with a full bucket of `burst` tokens, which
+/// refills at `rate` tokens per second, and each request takes one.
+/// Buckets are timed by the monotonic clock, so steps of the wall
+/// clock don't refill or freeze them.
+pub struct RateLimiter {
+    rate: f64,
+    burst: f64,
+    /// Maximum number of clients tracked at once
+    max_clients: usize,
+    /// Time without requests after which a client is forgotten
+    idle_timeout: Duration,
+    /// Buckets of clients seen since they were last full
+    buckets: Mutex<Buckets>,
+}
+
+/// Rate limiter state of all tracked clients
+#[derive(Default)]
+struct Buckets {
+    /// Counter ordering requests by recency
+    tick: u64,
+    clients: HashMap<IpAddr, TokenBucket>,
+    /// Clients by the tick of their latest request, oldest first
+    order: BTreeMap<u64, IpAddr>,
+}
+
+/// Rate limiter state of a single client
+struct TokenBucket {
+    tokens: f64,
+    updated: tokio::time::Instant,
+    /// Time of the client's latest request
+    last_request: tokio::time::Instant,
+    /// Tick of the client's latest request
+    tick: u64,
+}
+
+/// Address identifying a client to the rate limiter
+/// IPv6 clients are identified by their /64 prefix, which a single
+/// host can usually pick any address from, while IPv4-mapped
+/// addresses count as the IPv4 client.
+pub fn rate_limit_key(client: IpAddr) -> IpAddr {
+    match client {
+        IpAddr::V6(addr) => match addr.to_ipv4_mapped() {
+            Some(addr) => IpAddr::V4(addr),
+            None => IpAddr::V6(Ipv6Addr::from(u128::from(addr) & !(u128::MAX >> 64))),
+        },
+        IpAddr::V4(_) => client,
+    }
+}
+
+impl RateLimiter {
+    /// Create a limiter allowing `rate` requests per second,
+    /// in bursts of up to `burst`, for up to `max_clients` clients,
+    /// each forgotten after `idle_timeout` without requests
+    pub fn new(rate: f64, burst: u32, max_clients: usize, idle_timeout: Duration) -> Self {
+        RateLimiter {
+            rate,
+            burst: burst.into(),
+            max_clients,
+            idle_timeout,
+            buckets: Mutex::new(Buckets::default()),
+        }
+    }
+
+    /// Lock the buckets
+    /// A poisoned lock only risks a client's count, so we can reuse it.
+    fn lock(&self) -> MutexGuard<'_, Buckets> {
+        self.buckets.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Add the tokens earned between the bucket's last update and `now`
+    fn refill(&self, bucket: &mut TokenBucket, now: tokio::time::Instant) {
+        let elapsed = now.saturating_duration_since(bucket.updated).as_secs_f64();
+        bucket.tokens = (bucket.tokens + elapsed * self.rate).min(self.burst);
+        bucket.updated = bucket.updated.max(now);
+    }
+
+    /// Take a token for a request from `client` at time `now`
+    /// If none is available, returns the number of seconds until
+    /// one will be. Once `max_clients` are tracked, the client whose
+    /// latest request is oldest is dropped to make room, so each
+    /// request costs the same however many clients are tracked.
+    pub fn check(&self, client: IpAddr, now: tokio::time::Instant) -> Result<(), u64> {
+        let client = rate_limit_key(client);
+        let mut buckets = self.lock();
+        let Buckets {
+            tick,
+            clients,
+            order,
+        } = &mut *buckets;
+        *tick += 1;
+        if clients.len() >= self.max_clients && !clients.contains_key(&client) {
+            if let Some((_, oldest)) = order.pop_first() {
+                clients.remove(&oldest);
+            }
+        }
+        let bucket = clients.entry(client).or_insert(TokenBucket {
+            tokens: self.burst,
+            updated: now,
+            last_request: now,
+            tick: *tick,
+        });
+        order.remove(&bucket.tick);
+        order.insert(*tick, client);
+        bucket.tick = *tick;
+        self.refill(bucket, now);
+        bucket.last_request = bucket.last_request.max(now);
+        if bucket.tokens >= 1.0 {
+            bucket.tokens -= 1.0;
+            Ok(())
+        } else {
+            let wait = (1.0 - bucket.tokens) / self.rate;
+            Err((wait.ceil() as u64).max(1))
+        }
+    }
+
+    /// Forget clients whose buckets have refilled by time `now`, or
+    /// which have been idle beyond the idle timeout
+    /// A full bucket behaves the same as a new one, while an idle
+    /// client forgotten early regains its burst, bounding memory on
+    /// slowly refilling limits.
+    pub fn collect_garbage(&self, now: tokio::time::Instant) {
+        let mut buckets = self.lock();
+        let Buckets { clients, order, .. } = &mut *buckets;
+        clients.retain(|_, bucket| {
+            self.refill(bucket, now);
+            let idle = now.saturating_duration_since(bucket.last_request);
+            let keep = bucket.tokens < self.burst && idle < self.idle_timeout;
+            if !keep {
+                order.remove(&bucket.tick);
+            }
+            keep
+        });
+    }
+
+    /// Number of clients being tracked
+    pub fn client_count(&self) -> usize {
+        self.lock().clients.len()
+    }
+}
+
+/// Rolling window of recent evaluation durations
+pub struct LatencyWindow {
+    samples: VecDeque<Duration>,
+    capacity: usize,
+}
+
+impl LatencyWindow {
+    /// Create an empty window holding up to `capacity` samples
+    pub fn new(capacity: usize) -> Self {
+        LatencyWindow {
+            samples: VecDeque::with_capacity(capacity),
+            capacity,
+        }
+    }
+
+    /// Record a duration, discarding the oldest if the window is full
+    pub fn record(&mut self, duration: Duration) {
+        if self.samples.len() == self.capacity {
+            self.samples.pop_front();
+        }
+        self.samples.push_back(duration);
+    }
+
+    /// Number of durations in the window
+    pub fn sample_count(&self) -> usize {
+        self.samples.len()
+    }
+
+    /// Nearest-rank percentiles of the recorded durations,
+    /// or `None` if nothing has been recorded
+    pub fn percentiles<const N: usize>(&self, ranks: [u32; N]) -> Option<[Duration; N]> {
+        if self.samples.is_empty() {
+            return None;
+        }
+        let mut sorted: Vec<_> = self.samples.iter().copied().collect();
+        sorted.sort_unstable();
+        Some(ranks.map(|rank| {
+            let index = (rank as usize * sorted.len()).div_ceil(100);
+            sorted[index.clamp(1, sorted.len()) - 1]
+        }))
+    }
+}
+
+/// Epoch schedule settings which can be reloaded at runtime
+///
+/// Read from a JSON file, e.g.
+/// `{"epochDurations": {"main": "1d"}, "epochBaseTime": "2023-05-01T00:00:00Z"}`.
+/// Both fields are optional; instances not listed keep their
+/// current epoch duration.
+#[derive(Deserialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct ScheduleFile {
+    #[serde(default)]
+    epoch_durations: HashMap<String, String>,
+    epoch_base_time: Option<String>,
+}
+
+/// Error evaluating a batch of points
+#[derive(thiserror::Error, Debug)]
+pub enum EvalError {
+    #[error("Evaluation failed for point {index}: {source}")]
+    Failed {
+        /// Index of the failed point within the batch
+        index: usize,
+        source: ppoprf::PPRFError,
+    },
+    #[error("Evaluation deadline passed")]
+    TimedOut,
+}
+
+/// Errors loading or applying a new epoch schedule
+#[derive(thiserror::Error, Debug)]
+pub enum ScheduleError {
+    #[error("Couldn't read schedule file: {0}")]
+    Io(#[from] std::io::Error),
+    #[error("Couldn't parse schedule file: {0}")]
+    Json(#[from] serde_json::Error),
+    #[error("instance '{0}' not found")]
+    InstanceNotFound(String),
+    #[error("Invalid epoch base time '{0}'")]
+    BadTimestamp(String),
+    #[error("all epoch lengths must be non-zero")]
+    ZeroDuration,
+    #[error("key rotation interval must be non-zero")]
+    ZeroRotationInterval,
+    #[error("epoch base time should be in the past")]
+    FutureBaseTime,
+    #[error("instance '{instance_name}' can't move back from epoch {current} to {epoch}")]
+    Rewind {
+        instance_name: String,
+        current: u8,
+        epoch: u8,
+    },
+    #[error("Couldn't rotate to a new key: {0}")]
+    KeyRotation(ppoprf::PPRFError),
+}
+
+impl ScheduleFile {
+    /// Read schedule settings from the given file
+    pub fn load(path: &Path) -> Result<Self, ScheduleError> {
+        let contents = std::fs::read_to_string(path)?;
+        Ok(serde_json::from_str(&contents)?)
+    }
+
+    /// Return a copy of `config` with these settings applied
+    pub fn apply(&self, config: &Config) -> Result<Config, ScheduleError> {
+        let mut config = config.clone();
+        for (instance_name, duration) in &self.epoch_durations {
+            let index = config
+                .instance_names
+                .iter()
+                .position(|n| n == instance_name)
+                .ok_or_else(|| ScheduleError::InstanceNotFound(instance_name.clone()))?;
+            config.epoch_durations[index] = duration.as_str().into();
+        }
+        if let Some(stamp) = &self.epoch_base_time {
+            let base_time =
+                parse_timestamp(stamp).map_err(|_| ScheduleError::BadTimestamp(stamp.clone()))?;
+            config.epoch_base_time = Some(base_time);
+        }
+        Ok(config)
+    }
 }
 
 /// Arc wrapper for OPRFServer
@@ -50,48 +864,243 @@ pub type OPRFState = Arc<OPRFServer>;
 
 struct StartingEpochInfo {
     elapsed_epoch_count: usize,
+    epoch_start: OffsetDateTime,
     next_rotation: OffsetDateTime,
 }
 
 impl StartingEpochInfo {
-    fn calculate(base_time: OffsetDateTime, instance_epoch_duration: CalendarDuration) -> Self {
-        let now = time::OffsetDateTime::now_utc();
+    /// Locate the epoch containing an arbitrary time
+    ///
+    /// Epochs shorter than any month have a fixed length, so the
+    /// count is computed directly. Longer durations may include
+    /// months of varying length and are stepped through, which
+    /// takes at most one step per 28 days elapsed.
+    fn calculate_at(
+        base_time: OffsetDateTime,
+        instance_epoch_duration: CalendarDuration,
+        now: OffsetDateTime,
+    ) -> Self {
         let mut elapsed_epoch_count = 0;
+        let mut epoch_start = base_time;
         let mut next_rotation = base_time + instance_epoch_duration;
-        while next_rotation < now {
-            next_rotation = next_rotation + instance_epoch_duration;
-            elapsed_epoch_count += 1;
+        let epoch_length = next_rotation - base_time;
+        // Zero durations are rejected before any task starts, but
+        // don't spin forever if one gets this far.
+        if !epoch_length.is_positive() {
+            return Self {
+                elapsed_epoch_count,
+                epoch_start,
+                next_rotation,
+            };
+        }
+        if epoch_length < time::Duration::days(28) {
+            let elapsed = (now - base_time).whole_nanoseconds();
+            if elapsed > 0 {
+                // Epochs run up to and including their rotation time.
+                let count = (elapsed - 1) / epoch_length.whole_nanoseconds();
+                let offset = count * epoch_length.whole_nanoseconds();
+                let offset = time::Duration::new(
+                    (offset / 1_000_000_000) as i64,
+                    (offset % 1_000_000_000) as i32,
+                );
+                elapsed_epoch_count = count as usize;
+                epoch_start = base_time + offset;
+                next_rotation = epoch_start + epoch_length;
+            }
+        } else {
+            while next_rotation < now {
+                epoch_start = next_rotation;
+                next_rotation = next_rotation + instance_epoch_duration;
+                elapsed_epoch_count += 1;
+            }
         }
         Self {
             elapsed_epoch_count,
+            epoch_start,
             next_rotation,
         }
     }
 }
 
+/// Generate a fresh key for the configured epochs
+fn generate_key(config: &Config) -> Result<ppoprf::Server, ppoprf::PPRFError> {
+    // ppoprf wants a vector, so generate one from our range.
+    let epochs: Vec<u8> = (config.first_epoch..=config.last_epoch).collect();
+    ppoprf::Server::new(epochs)
+}
+
+/// Generate the key to follow the current one of an instance,
+/// if the last rotation consumed it
+/// The key is generated on a blocking thread without holding the
+/// instance lock, so neither requests nor the runtime are stalled,
+/// and installed once it's ready. If every attempt fails, the next
+/// rotation generates its key itself.
+pub async fn prepare_next_key(server: &RwLock<OPRFInstance>, config: &Config) {
+    if server.read().expect("Failed to lock OPRFServer").next_server.is_some() {
+        return;
+    }
+    for attempt in 1..=KEY_GENERATION_ATTEMPTS {
+        let key_config = config.clone();
+        let result = tokio::task::spawn_blocking(move || generate_key(&key_config)).await;
+        match result {
+            Ok(Ok(next_server)) => {
+                let mut s = server.write().expect("Failed to lock OPRFServer");
+                s.next_server.get_or_insert(next_server);
+                return;
+            }
+            Ok(Err(e)) => warn!("attempt {attempt} to generate the next key failed: {e}"),
+            Err(e) => warn!("attempt {attempt} to generate the next key panicked: {e}"),
+        }
+        counter!("key_generation_failures_total").increment(1);
+        if attempt < KEY_GENERATION_ATTEMPTS {
+            tokio::time::sleep(KEY_GENERATION_RETRY_DELAY).await;
+        }
+    }
+    error!("couldn't generate the next key, leaving it to the next rotation");
+}
+
+/// Build the pool evaluating large batches
+/// Sized by `--eval-threads`, defaulting to the number of available
+/// CPUs. A single thread evaluates on the caller instead.
+pub fn eval_pool(config: &Config) -> Option<Arc<rayon::ThreadPool>> {
+    let threads = config
+        .eval_threads
+        .unwrap_or_else(|| std::thread::available_parallelism().map_or(1, |n| n.get()));
+    if threads <= 1 {
+        return None;
+    }
+    let pool = rayon::ThreadPoolBuilder::new()
+        .num_threads(threads)
+        .thread_name(|index| format!("eval-{index}"))
+        .build()
+        .expect("should be able to start evaluation threads");
+    Some(Arc::new(pool))
+}
+
+/// Read a bearer token from a file, ignoring surrounding whitespace
+fn read_token(path: &Path) -> String {
+    let token = std::fs::read_to_string(path).unwrap_or_else(|e| {
+        panic!("should be able to read token file {}: {e}", path.display())
+    });
+    let token = token.trim().to_string();
+    assert!(!token.is_empty(), "token in {} must be non-empty", path.display());
+    token
+}
+
+/// Derive the offset of a server's epoch boundaries from its id
+/// The offset is uniformly distributed over `0..=max_jitter_ms`
+/// milliseconds, and stable for a given id.
+pub fn epoch_offset(server_id: &str, max_jitter_ms: u64) -> Duration {
+    let digest = Sha256::digest(server_id.as_bytes());
+    let value = u64::from_be_bytes(digest[..8].try_into().expect("digest is long enough"));
+    Duration::from_millis(value % max_jitter_ms.saturating_add(1))
+}
+
+/// Format the time of a scheduled rotation for publication
+/// Truncate to the second, or to the millisecond if the server's
+/// epoch `offset` has a fractional second, which it then keeps.
+pub fn rotation_timestamp(rotation: OffsetDateTime, offset: Duration) -> String {
+    let millisecond = match offset.subsec_millis() {
+        0 => 0,
+        _ => rotation.millisecond(),
+    };
+    rotation
+        .replace_millisecond(millisecond)
+        .expect("should be able to truncate to a fixed ms")
+        .format(&Rfc3339)
+        .expect("well-known timestamp format should always succeed")
+}
+
 impl OPRFServer {
     /// Initialize all OPRF instances with given configuration
     pub fn new(config: &Config) -> Arc<Self> {
+        Self::with_clock(config, Arc::new(OffsetDateTime::now_utc))
+    }
+
+    /// Initialize all OPRF instances, reading the time from `clock`
+    pub fn with_clock(config: &Config, clock: Clock) -> Arc<Self> {
+        let pool = eval_pool(config);
         let instances = config
             .instance_names
             .iter()
             .map(|instance_name| {
                 // Oblivious function state
                 info!(instance_name, "initializing OPRF state...");
-                let server = OPRFInstance::new(config).expect("Could not initialize PPOPRF state");
+                let server = OPRFInstance::new(config, pool.clone())
+                    .expect("Could not initialize PPOPRF state");
                 info!(instance_name, "epoch now {}", server.epoch);
 
                 (instance_name.to_string(), RwLock::new(server))
             })
             .collect();
+        // Each endpoint has its own limiter, so heavy use of one
+        // doesn't starve clients of the others.
+        let rate_limiter = |rate| {
+            RateLimiter::new(
+                rate,
+                config.rate_burst,
+                config.rate_limit_clients,
+                Duration::from_millis(config.rate_limit_idle_ms),
+            )
+        };
         Arc::new(OPRFServer {
             instances,
             default_instance: config.instance_names.first().cloned().unwrap(),
+            epoch_tasks: Mutex::new(HashMap::new()),
+            key_rotation_tasks: Mutex::new(HashMap::new()),
+            rate_limit_gc_task: Mutex::new(None),
+            rate_limit_gc_interval: Duration::from_millis(config.rate_limit_gc_interval_ms),
+            max_parse_time: config.max_parse_time_ms.map(Duration::from_millis),
+            eval_timeout: config.eval_timeout_ms.map(Duration::from_millis),
+            eval_permits: config.max_concurrent.map(|n| Arc::new(Semaphore::new(n))),
+            rate_limiter: config.rate_limit.map(rate_limiter),
+            info_rate_limiter: config.info_rate_limit.map(rate_limiter),
+            verify_rate_limiter: config.verify_rate_limit.map(rate_limiter),
+            client_ip_header: config.client_ip_header.clone(),
+            max_request_bytes: config.max_request_bytes,
+            max_points: config.max_points,
+            max_verifiable_points: config.max_verifiable_points,
+            strict_json: config.strict_json,
+            stale_loop_bound: config
+                .fail_closed_on_stale_loop
+                .then_some(config.stale_loop_bound),
+            max_schedule_entries: config.max_schedule_entries,
+            epoch_offset: config
+                .server_id
+                .as_deref()
+                .map(|id| epoch_offset(id, config.max_epoch_jitter_ms))
+                .unwrap_or_default(),
+            latency: config
+                .expose_latency
+                .then(|| Mutex::new(LatencyWindow::new(LATENCY_WINDOW))),
+            admin_token: config.admin_token_file.as_deref().map(read_token),
+            auth_token: config.auth_token_file.as_deref().map(read_token),
+            cors_origins: config
+                .cors_origins
+                .iter()
+                .map(|origin| origin.trim().to_string())
+                .filter(|origin| !origin.is_empty())
+                .collect(),
+            paused: AtomicBool::new(false),
+            clock,
         })
     }
 
+    /// Current time, as given by the server's clock
+    pub fn now(&self) -> OffsetDateTime {
+        (self.clock)()
+    }
+
     /// Start background tasks to keep OPRF instances up to date
-    pub fn start_background_tasks(self: &Arc<Self>, config: &Config) {
+    /// Fails without starting any task if an epoch duration or the
+    /// key rotation interval is zero, since it could never advance.
+    pub fn start_background_tasks(self: &Arc<Self>, config: &Config) -> Result<(), ScheduleError> {
+        if config.epoch_durations.iter().any(|d| d.is_zero()) {
+            return Err(ScheduleError::ZeroDuration);
+        }
+        if config.key_rotation_interval.is_some_and(|d| d.is_zero()) {
+            return Err(ScheduleError::ZeroRotationInterval);
+        }
         for (instance_name, instance_epoch_duration) in config
             .instance_names
             .iter()
@@ -100,13 +1109,278 @@ impl OPRFServer {
         {
             // Spawn a background process to advance the epoch
             info!(instance_name, "Spawning background epoch rotation task...");
+            self.spawn_epoch_loop(config, instance_name, instance_epoch_duration);
+        }
+
+        if let Some(key_rotation_interval) = config.key_rotation_interval {
+            for instance_name in config.instance_names.iter().cloned() {
+                // Spawn a background process to periodically replace the key
+                info!(instance_name, "Spawning background key rotation task...");
+                self.spawn_key_rotation_loop(config, instance_name, key_rotation_interval);
+            }
+        }
+
+        if self.rate_limiters().next().is_some() {
+            // Spawn a background process to drop idle clients
+            info!("Spawning background rate limiter cleanup task...");
             let background_state = self.clone();
-            let background_config = config.clone();
-            tokio::spawn(async move {
-                background_state
-                    .epoch_loop(background_config, instance_name, instance_epoch_duration)
-                    .await
-            });
+            let task = tokio::spawn(async move { background_state.rate_limit_gc_loop().await });
+            let mut gc_task = self
+                .rate_limit_gc_task
+                .lock()
+                .expect("should be able to lock rate_limit_gc_task");
+            if let Some(task) = gc_task.replace(task.abort_handle()) {
+                task.abort();
+            }
+        }
+        Ok(())
+    }
+
+    /// The rate limiters which are enabled
+    fn rate_limiters(&self) -> impl Iterator<Item = &RateLimiter> {
+        [
+            &self.rate_limiter,
+            &self.info_rate_limiter,
+            &self.verify_rate_limiter,
+        ]
+        .into_iter()
+        .flatten()
+    }
+
+    /// Periodically drop idle clients from the rate limiters,
+    /// so their memory is bounded by the number of active clients
+    async fn rate_limit_gc_loop(&self) {
+        let mut interval = tokio::time::interval(self.rate_limit_gc_interval);
+        loop {
+            interval.tick().await;
+            for limiter in self.rate_limiters() {
+                limiter.collect_garbage(tokio::time::Instant::now());
+                debug!("rate limiter tracking {} clients", limiter.client_count());
+            }
+        }
+    }
+
+    /// Stop all background tasks
+    /// The tasks hold references to the server, so this lets the
+    /// OPRF state, including the private keys, be dropped.
+    pub fn stop_background_tasks(&self) {
+        let mut epoch_tasks = self
+            .epoch_tasks
+            .lock()
+            .expect("should be able to lock epoch_tasks");
+        for (_, task) in epoch_tasks.drain() {
+            task.abort();
+        }
+        let mut key_rotation_tasks = self
+            .key_rotation_tasks
+            .lock()
+            .expect("should be able to lock key_rotation_tasks");
+        for (_, task) in key_rotation_tasks.drain() {
+            task.abort();
+        }
+        let mut gc_task = self
+            .rate_limit_gc_task
+            .lock()
+            .expect("should be able to lock rate_limit_gc_task");
+        if let Some(task) = gc_task.take() {
+            task.abort();
+        }
+    }
+
+    /// Spawn the epoch rotation task for an instance
+    /// Any task already running for the instance is stopped.
+    fn spawn_epoch_loop(
+        self: &Arc<Self>,
+        config: &Config,
+        instance_name: String,
+        instance_epoch_duration: CalendarDuration,
+    ) {
+        let mut epoch_tasks = self
+            .epoch_tasks
+            .lock()
+            .expect("should be able to lock epoch_tasks");
+        if let Some(task) = epoch_tasks.remove(&instance_name) {
+            task.abort();
+        }
+        let background_state = self.clone();
+        let background_config = config.clone();
+        let background_name = instance_name.clone();
+        let task = tokio::spawn(async move {
+            background_state
+                .epoch_loop(background_config, background_name, instance_epoch_duration)
+                .await
+        });
+        epoch_tasks.insert(instance_name, task.abort_handle());
+    }
+
+    /// Spawn the key rotation task for an instance
+    /// Any task already running for the instance is stopped.
+    fn spawn_key_rotation_loop(
+        self: &Arc<Self>,
+        config: &Config,
+        instance_name: String,
+        key_rotation_interval: CalendarDuration,
+    ) {
+        let mut key_rotation_tasks = self
+            .key_rotation_tasks
+            .lock()
+            .expect("should be able to lock key_rotation_tasks");
+        if let Some(task) = key_rotation_tasks.remove(&instance_name) {
+            task.abort();
+        }
+        let background_state = self.clone();
+        let background_config = config.clone();
+        let background_name = instance_name.clone();
+        let task = tokio::spawn(async move {
+            background_state
+                .key_rotation_loop(background_config, background_name, key_rotation_interval)
+                .await
+        });
+        key_rotation_tasks.insert(instance_name, task.abort_handle());
+    }
+
+    /// Apply a new epoch schedule
+    ///
+    /// The schedule in `config` is checked against every instance
+    /// before any change is made, so on error the current schedule
+    /// stays in place, short of a failure generating a new key.
+    /// Instances may skip ahead, puncturing the epochs in between,
+    /// but can't return to an earlier epoch.
+    /// Epochs are compared by the number elapsed since the base
+    /// time rather than by tag, since tags repeat with each key.
+    /// Skipping past the last epoch rotates the key, as the epoch
+    /// rotation task would have, and any key rotation task is
+    /// restarted to follow the new base time.
+    pub fn reload_schedule(self: &Arc<Self>, config: &Config) -> Result<(), ScheduleError> {
+        let now = self.now();
+        let epochs = config.first_epoch..=config.last_epoch;
+        let mut schedules = Vec::with_capacity(config.instance_names.len());
+        for (instance_name, epoch_duration) in config
+            .instance_names
+            .iter()
+            .zip(config.epoch_durations.iter().cloned())
+        {
+            if epoch_duration.is_zero() {
+                return Err(ScheduleError::ZeroDuration);
+            }
+            let server = self
+                .instances
+                .get(instance_name)
+                .expect("OPRFServer should exist for instance name")
+                .read()
+                .expect("Failed to lock OPRFServer");
+            // Keep the current base time unless a new one is given.
+            let base_time = config
+                .epoch_base_time
+                .or(server.schedule.map(|s| s.base_time - self.epoch_offset))
+                .unwrap_or(now);
+            if base_time > now {
+                return Err(ScheduleError::FutureBaseTime);
+            }
+            let elapsed = |base_time, epoch_duration| {
+                StartingEpochInfo::calculate_at(base_time, epoch_duration, now).elapsed_epoch_count
+            };
+            // Before the epoch rotation task starts, only the
+            // current key's epochs can have elapsed.
+            let current = match server.schedule {
+                Some(schedule) => elapsed(schedule.base_time, schedule.epoch_duration),
+                None => usize::from(server.epoch - epochs.start()),
+            };
+            let count = elapsed(base_time + self.epoch_offset, epoch_duration);
+            if count < current {
+                return Err(ScheduleError::Rewind {
+                    instance_name: instance_name.clone(),
+                    current: server.epoch,
+                    epoch: epochs.start() + (count % epochs.len()) as u8,
+                });
+            }
+            let new_key = count / epochs.len() > current / epochs.len();
+            schedules.push((instance_name.clone(), base_time, epoch_duration, new_key));
+        }
+
+        for (instance_name, base_time, epoch_duration, new_key) in schedules {
+            if new_key {
+                info!(instance_name, "Epochs exhausted by new schedule! Rotating OPRF key");
+                let mut s = self
+                    .instances
+                    .get(&instance_name)
+                    .expect("OPRFServer should exist for instance name")
+                    .write()
+                    .expect("Failed to lock OPRFServer");
+                // The epoch rotation task punctures up to the
+                // current epoch of the new key.
+                s.epoch = config.first_epoch;
+                s.rotate_key(config).map_err(ScheduleError::KeyRotation)?;
+            }
+            info!(instance_name, "Restarting epoch rotation task with new schedule...");
+            let config = Config {
+                epoch_base_time: Some(base_time),
+                ..config.clone()
+            };
+            self.spawn_epoch_loop(&config, instance_name.clone(), epoch_duration);
+            if let Some(key_rotation_interval) = config.key_rotation_interval {
+                info!(instance_name, "Restarting key rotation task with new schedule...");
+                self.spawn_key_rotation_loop(&config, instance_name, key_rotation_interval);
+            }
+        }
+        Ok(())
+    }
+
+    /// Rotate to a fresh key on a timer
+    /// This can be invoked as a background task to replace the
+    /// key of the given instance at a fixed cadence, regardless
+    /// of how many epochs remain in the current key.
+    #[instrument(skip(self, config, key_rotation_interval))]
+    async fn key_rotation_loop(
+        self: Arc<Self>,
+        config: Config,
+        instance_name: String,
+        key_rotation_interval: CalendarDuration,
+    ) {
+        let server = self
+            .instances
+            .get(&instance_name)
+            .expect("OPRFServer should exist for instance name");
+
+        info!("rotating key every {key_rotation_interval}");
+
+        // Anchor the rotation schedule to the same base time
+        // as the epoch schedule.
+        let start_time = self.now();
+        let base_time = config.epoch_base_time.unwrap_or(start_time) + self.epoch_offset;
+        let StartingEpochInfo {
+            mut next_rotation, ..
+        } = StartingEpochInfo::calculate_at(base_time, key_rotation_interval, start_time);
+
+        loop {
+            let timestamp = rotation_timestamp(next_rotation, self.epoch_offset);
+            {
+                let mut s = server
+                    .write()
+                    .expect("should be able to update next_key_rotation_time");
+                s.next_key_rotation_time = Some(timestamp);
+                s.key_rotation_deadline = Some(next_rotation);
+            }
+
+            // Wait until the current key expires.
+            let sleep_duration = next_rotation - self.now();
+            if sleep_duration.is_positive() {
+                tokio::time::sleep(sleep_duration.unsigned_abs()).await;
+            }
+            next_rotation = next_rotation + key_rotation_interval;
+
+            // Taking the write lock serializes this with epoch
+            // advance, so the new key always matches the current epoch.
+            {
+                let mut s = server.write().expect("Failed to lock OPRFServer");
+                s.rotate_key(&config)
+                    .expect("Could not initialize new PPOPRF server");
+                info!(
+                    "key rotated at epoch {}, next key rotation = {next_rotation}",
+                    s.epoch
+                );
+            }
+            prepare_next_key(server, &config).await;
         }
     }
 
@@ -128,10 +1402,10 @@ impl OPRFServer {
 
         info!("rotating epoch every {instance_epoch_duration}");
 
-        let start_time = OffsetDateTime::now_utc();
+        let start_time = self.now();
         // Epoch base_time comes from a config argument if given,
-        // otherwise use start_time.
-        let base_time = config.epoch_base_time.unwrap_or(start_time);
+        // otherwise use start_time, delayed by any server offset.
+        let base_time = config.epoch_base_time.unwrap_or(start_time) + self.epoch_offset;
         info!(
             "epoch base time = {}",
             base_time
@@ -139,47 +1413,55 @@ impl OPRFServer {
                 .expect("well-known timestamp format should always succeed")
         );
 
+        // Wait for the first epoch if the schedule starts in the future.
+        // The instance isn't reported as ready until then.
+        let delay = base_time - start_time;
+        if delay.is_positive() {
+            info!("waiting {delay} for the first epoch");
+            tokio::time::sleep(delay.unsigned_abs()).await;
+            info!("first epoch has begun");
+        }
+
         // Calculate where we are in the epoch schedule relative to the
         // base time. We may need to start in the middle of the range.
-        assert!(
-            start_time >= base_time,
-            "epoch-base-time should be in the past"
-        );
         let StartingEpochInfo {
             elapsed_epoch_count,
+            mut epoch_start,
             mut next_rotation,
-        } = StartingEpochInfo::calculate(base_time, instance_epoch_duration);
+        } = StartingEpochInfo::calculate_at(base_time, instance_epoch_duration, self.now());
 
         // The `epochs` range is `u8`, so the length can be no more
         // than `u8::MAX + 1`, making it safe to truncate the modulo.
         let offset = elapsed_epoch_count % epochs.len();
         let current_epoch = epochs.start() + offset as u8;
 
-        // Advance to the current epoch if base time indicates we started
-        // in the middle of a sequence.
-        if current_epoch != config.first_epoch {
-            info!(
-                "Puncturing obsolete epochs {}..{} to match base time",
-                config.first_epoch, current_epoch
-            );
+        {
             let mut s = server.write().expect("Failed to lock OPRFServer");
-            for epoch in config.first_epoch..current_epoch {
-                s.server
-                    .puncture(epoch)
-                    .expect("Failed to puncture obsolete epoch");
+            s.schedule = Some(EpochSchedule {
+                base_time,
+                epoch_duration: instance_epoch_duration,
+            });
+
+            // Advance to the current epoch if base time indicates we started
+            // in the middle of a sequence, or the schedule was reloaded.
+            if current_epoch > s.epoch {
+                info!(
+                    "Puncturing obsolete epochs {}..{} to match base time",
+                    s.epoch, current_epoch
+                );
+                for epoch in s.epoch..current_epoch {
+                    s.puncture(epoch)
+                        .expect("Failed to puncture obsolete epoch");
+                }
+                s.epoch = current_epoch;
+                info!("epoch now {}, next rotation = {next_rotation}", s.epoch);
             }
-            s.epoch = current_epoch;
-            info!("epoch now {}, next rotation = {next_rotation}", s.epoch);
         }
 
         loop {
             // Pre-calculate the next_epoch_time for the InfoResponse hander.
-            // Truncate to the nearest second.
-            let timestamp = next_rotation
-                .replace_millisecond(0)
-                .expect("should be able to truncate to a fixed ms")
-                .format(&Rfc3339)
-                .expect("well-known timestamp format should always succeed");
+            let timestamp = rotation_timestamp(next_rotation, self.epoch_offset);
+            let start_timestamp = rotation_timestamp(epoch_start, self.epoch_offset);
             {
                 // Acquire a temporary write lock which should be dropped
                 // before sleeping. The locking should not fail, but if it
@@ -189,41 +1471,30 @@ impl OPRFServer {
                     .write()
                     .expect("should be able to update next_epoch_time");
                 s.next_epoch_time = Some(timestamp);
+                s.epoch_start_time = Some(start_timestamp);
+                s.epoch_start = Some(epoch_start);
+                s.epoch_deadline = Some(next_rotation);
             }
 
             // Wait until the current epoch ends.
-            let sleep_duration = next_rotation - time::OffsetDateTime::now_utc();
+            let sleep_duration = next_rotation - self.now();
             // Negative durations mean we're behind.
             if sleep_duration.is_positive() {
                 tokio::time::sleep(sleep_duration.unsigned_abs()).await;
             }
+            epoch_start = next_rotation;
             next_rotation = next_rotation + instance_epoch_duration;
 
             // Acquire exclusive access to the oprf state.
             // Panics if this fails, since processing requests with an
             // expired epoch weakens user privacy.
-            let mut s = server.write().expect("Failed to lock OPRFServer");
-
-            // Puncture the current epoch so it can no longer be used.
-            let old_epoch = s.epoch;
-            s.server
-                .puncture(old_epoch)
-                .expect("Failed to puncture current epoch");
-
-            // Advance to the next epoch, checking for overflow
-            // and out-of-range.
-            let new_epoch = old_epoch.checked_add(1);
-            if new_epoch.filter(|e| epochs.contains(e)).is_some() {
-                // Server is already initialized for this one.
-                s.epoch = new_epoch.unwrap();
-            } else {
-                info!("Epochs exhausted! Rotating OPRF key");
-                // Panics if this fails. Puncture should mean we can't
-                // violate privacy through further evaluations, but we
-                // still want to drop the inner state with its private key.
-                *s = OPRFInstance::new(&config).expect("Could not initialize new PPOPRF server");
-            }
-            info!("epoch now {}, next rotation = {next_rotation}", s.epoch);
+            {
+                let mut s = server.write().expect("Failed to lock OPRFServer");
+                s.advance_epoch(&config)
+                    .expect("Failed to advance to the next epoch");
+                debug!("epoch now {}, next rotation = {next_rotation}", s.epoch);
+            }
+            prepare_next_key(server, &config).await;
         }
     }
 }
@@ -6,8 +6,12 @@ use axum::http::Request;
 use axum::http::StatusCode;
 use base64::prelude::{Engine as _, BASE64_STANDARD as BASE64};
 use curve25519_dalek::ristretto::{CompressedRistretto, RistrettoPoint};
+use hkdf::Hkdf;
 use rand::rngs::OsRng;
+use metrics::{Key, KeyName, Metadata, SharedString, Unit};
 use serde_json::{json, Value};
+use sha2::Sha256;
+use std::sync::atomic::{AtomicU64, Ordering};
 use std::time::Duration;
 use time::OffsetDateTime;
 use tower::Service;
@@ -18,23 +22,63 @@ const EPOCH: u8 = 12;
 const NEXT_EPOCH_TIME: &str = "2023-03-22T21:46:35Z";
 
 /// Maximum size of a response body to consider
-/// This is an approximate bound to allow for crate::MAX_POINTS.
+/// This is an approximate bound to allow for crate::DEFAULT_MAX_POINTS.
 /// The exact size is 32 bytes per point, plus base64 and json overhead.
 const RESPONSE_MAX: usize = 48*1024;
 
+/// Metrics recorder totalling each counter, so tests can check
+/// metrics without installing a global recorder
+#[derive(Default)]
+struct CountingRecorder {
+    counters: std::sync::Mutex<std::collections::HashMap<String, std::sync::Arc<AtomicU64>>>,
+}
+
+impl CountingRecorder {
+    /// Total of a counter, identified as `name{label=value,...}`
+    /// with the labels in the order they're given
+    fn count(&self, key: &str) -> u64 {
+        let counters = self.counters.lock().unwrap();
+        counters.get(key).map_or(0, |counter| counter.load(Ordering::Relaxed))
+    }
+}
+
+impl metrics::Recorder for CountingRecorder {
+    fn describe_counter(&self, _: KeyName, _: Option<Unit>, _: SharedString) {}
+    fn describe_gauge(&self, _: KeyName, _: Option<Unit>, _: SharedString) {}
+    fn describe_histogram(&self, _: KeyName, _: Option<Unit>, _: SharedString) {}
+
+    fn register_counter(&self, key: &Key, _: &Metadata<'_>) -> metrics::Counter {
+        let labels: Vec<String> = key
+            .labels()
+            .map(|label| format!("{}={}", label.key(), label.value()))
+            .collect();
+        let name = format!("{}{{{}}}", key.name(), labels.join(","));
+        let mut counters = self.counters.lock().unwrap();
+        metrics::Counter::from_arc(counters.entry(name).or_default().clone())
+    }
+
+    fn register_gauge(&self, _: &Key, _: &Metadata<'_>) -> metrics::Gauge {
+        metrics::Gauge::noop()
+    }
+
+    fn register_histogram(&self, _: &Key, _: &Metadata<'_>) -> metrics::Histogram {
+        metrics::Histogram::noop()
+    }
+}
+
 struct InstanceConfig {
     instance_name: String,
     epoch_duration: String,
 }
 
-/// Create an app instance for testing
-fn test_app(instance_configs: Option<Vec<InstanceConfig>>) -> crate::Router {
+/// Create a server configuration for testing
+fn test_config(instance_configs: Option<Vec<InstanceConfig>>) -> crate::Config {
     let instance_configs = instance_configs.unwrap_or(vec![InstanceConfig {
         instance_name: "main".to_string(),
         epoch_duration: "1s".to_string(),
     }]);
     // arbitrary config
-    let config = crate::Config {
+    crate::Config {
         listen: "127.0.0.1:8081".to_string(),
         epoch_durations: instance_configs
             .iter()
@@ -43,13 +87,51 @@ fn test_app(instance_configs: Option<Vec<InstanceConfig>>) -> crate::Router {
         first_epoch: EPOCH,
         last_epoch: EPOCH * 2,
         epoch_base_time: None,
+        key_rotation_interval: None,
+        schedule_file: None,
+        max_parse_time_ms: None,
+        eval_timeout_ms: None,
+        max_concurrent: None,
+        rate_limit: None,
+        info_rate_limit: None,
+        verify_rate_limit: None,
+        rate_burst: 10,
+        rate_limit_clients: 100_000,
+        rate_limit_idle_ms: 600_000,
+        rate_limit_gc_interval_ms: 60_000,
+        client_ip_header: None,
+        fail_closed_on_stale_loop: false,
+        stale_loop_bound: "5s".into(),
+        max_schedule_entries: 256,
+        max_points: crate::DEFAULT_MAX_POINTS,
+        max_verifiable_points: 256,
+        strict_json: false,
+        max_request_bytes: 2 * 1024 * 1024,
+        server_id: None,
+        max_epoch_jitter_ms: 0,
+        expose_latency: false,
+        admin_token_file: None,
+        auth_token_file: None,
+        cors_origins: Vec::new(),
+        eval_cache_size: 0,
+        eval_threads: None,
+        key_history_size: 4,
+        shutdown_timeout_ms: 10_000,
         increase_nofile_limit: false,
+        log_format: crate::LogFormat::Text,
+        log_level: tracing::metadata::LevelFilter::INFO,
         prometheus_listen: None,
+        pprof_listen: None,
         instance_names: instance_configs
             .into_iter()
             .map(|c| c.instance_name)
             .collect(),
-    };
+    }
+}
+
+/// Create an app instance for testing
+fn test_app(instance_configs: Option<Vec<InstanceConfig>>) -> crate::Router {
+    let config = test_config(instance_configs);
     // server state
     let oprf_state = OPRFServer::new(&config);
     for instance in oprf_state.instances.values() {
@@ -100,12 +182,22 @@ fn validate_info_response_and_return_public_key_b64(status: StatusCode, body: By
         serde_json::from_slice(body.as_ref()).expect("Could not parse response body as json");
     assert!(json.is_object());
     assert_eq!(json["currentEpoch"], json!(EPOCH));
+    assert_eq!(json["remainingEpochs"], json!(EPOCH * 2 - EPOCH));
     assert!(json["nextEpochTime"].is_string());
     let next_epoch_time = json["nextEpochTime"].as_str().unwrap();
     assert_eq!(next_epoch_time, NEXT_EPOCH_TIME);
     assert!(json["maxPoints"].is_number());
     let max_points = json["maxPoints"].as_u64().unwrap();
-    assert_eq!(max_points, crate::MAX_POINTS as u64);
+    assert_eq!(max_points, crate::DEFAULT_MAX_POINTS as u64);
+    assert_eq!(json["maxRequestBytes"], json!(2 * 1024 * 1024));
+    assert_eq!(json["epochOffsetMs"], json!(0));
+    assert_eq!(
+        json["proofsSupported"],
+        json!(crate::handler::PROOFS_SUPPORTED)
+    );
+    assert_eq!(json["curve"], "ristretto255");
+    assert_eq!(json["hash"], "SHA-512");
+    assert_eq!(json["outputLength"], json!(32));
     assert!(json["publicKey"].is_string());
     let b64key = json["publicKey"].as_str().unwrap();
     let binkey = BASE64.decode(b64key).unwrap();
@@ -271,14 +363,8 @@ async fn epoch_base_time() {
 
     // Config with explicit base time
     let config = crate::Config {
-        listen: "127.0.0.1:8081".to_string(),
-        epoch_durations: vec!["1s".into()],
-        first_epoch: EPOCH,
-        last_epoch: EPOCH * 2,
         epoch_base_time: Some(now - delay),
-        increase_nofile_limit: false,
-        prometheus_listen: None,
-        instance_names: vec!["main".to_string()],
+        ..test_config(None)
     };
     // Verify test parameters are compatible with the
     // expected_epoch calculation.
@@ -295,7 +381,7 @@ async fn epoch_base_time() {
     // server state
     let oprf_state = OPRFServer::new(&config);
     // background task to manage epoch rotation
-    oprf_state.start_background_tasks(&config);
+    oprf_state.start_background_tasks(&config).unwrap();
 
     // Wait for `epoch_loop` to update `next_epoch_time` as a proxy
     // for completing epoch schedule initialization. Use a timeout
@@ -329,6 +415,54 @@ async fn epoch_base_time() {
     assert_eq!(next_epoch_time, expected_time);
 }
 
+/// If --key-rotation-interval is set, confirm the key changes
+/// on schedule without disturbing the current epoch.
+/// The server's clock follows tokio's, which is paused here.
+#[tokio::test(start_paused = true)]
+async fn key_rotation_interval() {
+    // Long epochs so only the key rotation is observed.
+    let config = crate::Config {
+        key_rotation_interval: Some("1s".into()),
+        ..test_config(Some(vec![InstanceConfig {
+            instance_name: "main".to_string(),
+            epoch_duration: "1h".to_string(),
+        }]))
+    };
+    let start = OffsetDateTime::now_utc();
+    let origin = tokio::time::Instant::now();
+    let clock = std::sync::Arc::new(move || start + origin.elapsed());
+    let oprf_state = OPRFServer::with_clock(&config, clock);
+    oprf_state.start_background_tasks(&config).unwrap();
+
+    // Wait for `key_rotation_loop` to publish its schedule.
+    let pause = Duration::from_millis(10);
+    let mut tries = 0;
+    let oprf_instance = oprf_state.instances.get("main").unwrap();
+    while oprf_instance.read().unwrap().next_key_rotation_time.is_none() {
+        assert!(tries < 10, "timeout waiting for key_rotation_loop initialization");
+        tokio::time::sleep(pause).await;
+        tries += 1;
+    }
+
+    let mut app = crate::app(oprf_state);
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert!(json["nextKeyRotationTime"].is_string());
+    let first_key = json["publicKey"].clone();
+
+    // Wait past the next rotation.
+    tokio::time::sleep(Duration::from_millis(1500)).await;
+
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_ne!(json["publicKey"], first_key);
+    assert_eq!(json["currentEpoch"], json!(EPOCH));
+}
+
 /// Check a randomness response body for validity
 fn verify_randomness_body(body: &Bytes, expected_points: usize) {
     // Randomness should return a list of points and an epoch.
@@ -382,21 +516,3220 @@ async fn point_batches() {
 
     // Check that we can submit a reasonable number of points.
     let points = make_points(128);
-    assert!(points.len() < crate::MAX_POINTS);
+    assert!(points.len() < crate::DEFAULT_MAX_POINTS);
     verify_batch(&points).await;
 }
 
 #[tokio::test]
 async fn max_points() {
     // Check that we can submit the maximum number of points.
-    let points = make_points(crate::MAX_POINTS);
+    let points = make_points(crate::DEFAULT_MAX_POINTS);
     verify_batch(&points).await;
 
     // Requests with more than the maximum number of points
     // should be rejected.
-    let points = make_points(crate::MAX_POINTS + 1);
+    let points = make_points(crate::DEFAULT_MAX_POINTS + 1);
     let payload = json!({ "points": points }).to_string();
     let request = test_request("/randomness", Some(payload));
     let response = test_app(None).oneshot(request).await.unwrap();
     assert_eq!(response.status(), StatusCode::BAD_REQUEST);
 }
+
+#[tokio::test]
+async fn multi_randomness() {
+    let mut app = test_app(None);
+
+    // Mix valid requests with a bad epoch and a bad point.
+    let points = make_points(3);
+    let payload = json!([
+        { "points": points },
+        { "points": points, "epoch": EPOCH + 1 },
+        { "points": ["not a point"] },
+        { "points": points, "epoch": EPOCH },
+    ])
+    .to_string();
+    let request = test_request("/randomness/multi", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let results = json.as_array().unwrap();
+    assert_eq!(results.len(), 4);
+    // Failures are reported per request without affecting the others.
+    for index in [0, 3] {
+        let body = serde_json::to_vec(&results[index]).unwrap();
+        verify_randomness_body(&body.into(), points.len());
+    }
+    for index in [1, 2] {
+        assert!(results[index]["message"].is_string());
+        assert!(results[index]["points"].is_null());
+    }
+    // Requests are isolated, but evaluated with the same key.
+    assert_eq!(results[0], results[3]);
+
+    let response = app
+        .call(test_request("/instances/main/randomness/multi", Some(payload)))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // The point limit applies to the whole batch.
+    let half = make_points(crate::DEFAULT_MAX_POINTS / 2 + 1);
+    let payload = json!([{ "points": half }, { "points": half }]).to_string();
+    let request = test_request("/randomness/multi", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn hkdf_expansion() {
+    let mut app = test_app(None);
+    let points = make_points(3);
+    let salt = b"star-randsrv test salt";
+    let info = b"test context";
+    let length = 48;
+
+    // Fetch the raw outputs so we can expand them client-side.
+    let payload = json!({ "points": points }).to_string();
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let raw: Value = serde_json::from_slice(&body).unwrap();
+
+    let payload = json!({
+        "points": points,
+        "hkdf": {
+            "salt": BASE64.encode(salt),
+            "info": BASE64.encode(info),
+            "length": length,
+        }
+    })
+    .to_string();
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let expanded: Value = serde_json::from_slice(&body).unwrap();
+
+    let raw = raw["points"].as_array().unwrap();
+    let expanded = expanded["points"].as_array().unwrap();
+    assert_eq!(raw.len(), expanded.len());
+    for (raw, expanded) in raw.iter().zip(expanded) {
+        let ikm = BASE64.decode(raw.as_str().unwrap()).unwrap();
+        let mut okm = vec![0u8; length];
+        Hkdf::<Sha256>::new(Some(salt), &ikm)
+            .expand(info, &mut okm)
+            .unwrap();
+        assert_eq!(BASE64.decode(expanded.as_str().unwrap()).unwrap(), okm);
+    }
+
+    // Output lengths out of range should be rejected.
+    for length in [0, 257] {
+        let payload = json!({
+            "points": points,
+            "hkdf": { "salt": BASE64.encode(salt), "length": length }
+        })
+        .to_string();
+        let request = test_request("/randomness", Some(payload));
+        let response = app.call(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    }
+}
+
+/// Confirm a new epoch schedule can be applied to a running
+/// server without changing its key, and that invalid schedules
+/// are rejected.
+#[tokio::test]
+async fn reload_schedule() {
+    let config = test_config(Some(vec![InstanceConfig {
+        instance_name: "main".to_string(),
+        epoch_duration: "10s".to_string(),
+    }]));
+    let oprf_state = OPRFServer::new(&config);
+    oprf_state.start_background_tasks(&config).unwrap();
+
+    // Wait for `epoch_loop` to publish its schedule.
+    let pause = Duration::from_millis(10);
+    let mut tries = 0;
+    let oprf_instance = oprf_state.instances.get("main").unwrap();
+    while oprf_instance.read().unwrap().next_epoch_time.is_none() {
+        assert!(tries < 10, "timeout waiting for epoch_loop initialization");
+        tokio::time::sleep(pause).await;
+        tries += 1;
+    }
+    let public_key = || {
+        let s = oprf_instance.read().unwrap();
+        s.server.get_public_key().serialize_to_bincode().unwrap()
+    };
+    let next_epoch_time = || {
+        let s = oprf_instance.read().unwrap();
+        let stamp = s.next_epoch_time.clone().unwrap();
+        OffsetDateTime::parse(&stamp, &time::format_description::well_known::Rfc3339).unwrap()
+    };
+    let original_key = public_key();
+    let original_time = next_epoch_time();
+
+    // A base time in the future is invalid.
+    let future = crate::Config {
+        epoch_base_time: Some(OffsetDateTime::now_utc() + Duration::from_secs(3600)),
+        ..config.clone()
+    };
+    assert!(oprf_state.reload_schedule(&future).is_err());
+    tokio::time::sleep(pause).await;
+    assert_eq!(next_epoch_time(), original_time);
+
+    // Lengthen the epoch.
+    let longer = crate::Config {
+        epoch_durations: vec!["1h".into()],
+        ..config.clone()
+    };
+    oprf_state.reload_schedule(&longer).unwrap();
+    let mut tries = 0;
+    while next_epoch_time() == original_time {
+        assert!(tries < 10, "timeout waiting for epoch_loop restart");
+        tokio::time::sleep(pause).await;
+        tries += 1;
+    }
+    assert!(next_epoch_time() > OffsetDateTime::now_utc() + Duration::from_secs(1800));
+    assert_eq!(oprf_instance.read().unwrap().epoch, EPOCH);
+    assert_eq!(public_key(), original_key);
+}
+
+/// Confirm reloads compare elapsed epochs rather than tags, so a
+/// schedule which wraps past the last epoch rotates the key
+#[tokio::test]
+async fn reload_schedule_wrap() {
+    use time::format_description::well_known::Rfc3339;
+
+    let now = OffsetDateTime::parse(NEXT_EPOCH_TIME, &Rfc3339).unwrap();
+    let schedule = |elapsed: u64| crate::Config {
+        epoch_durations: vec!["10s".into()],
+        epoch_base_time: Some(now - Duration::from_secs(elapsed * 10 + 5)),
+        key_rotation_interval: Some("1h".into()),
+        ..test_config(None)
+    };
+    let config = schedule(1);
+    let oprf_state = OPRFServer::with_clock(&config, std::sync::Arc::new(move || now));
+    oprf_state.start_background_tasks(&config).unwrap();
+    wait_for_schedule(&oprf_state).await;
+    let oprf_instance = &oprf_state.instances["main"];
+    let public_key = || {
+        let s = oprf_instance.read().unwrap();
+        s.server.get_public_key().serialize_to_bincode().unwrap()
+    };
+    let original_key = public_key();
+    assert_eq!(oprf_instance.read().unwrap().epoch, EPOCH + 1);
+
+    // Moving back to the first epoch is a rewind.
+    assert!(matches!(
+        oprf_state.reload_schedule(&schedule(0)),
+        Err(crate::state::ScheduleError::Rewind { .. })
+    ));
+
+    // Skipping to the first epoch of the next key isn't, though
+    // its tag is lower.
+    let epoch_count = u64::from(config.last_epoch - config.first_epoch) + 1;
+    let wrapped = schedule(epoch_count);
+    oprf_state.reload_schedule(&wrapped).unwrap();
+    assert_ne!(public_key(), original_key);
+    let base_time = || oprf_instance.read().unwrap().schedule.unwrap().base_time;
+    let pause = Duration::from_millis(10);
+    let mut tries = 0;
+    while base_time() != wrapped.epoch_base_time.unwrap() {
+        assert!(tries < 10, "timeout waiting for epoch_loop restart");
+        tokio::time::sleep(pause).await;
+        tries += 1;
+    }
+    assert_eq!(oprf_instance.read().unwrap().epoch, EPOCH);
+
+    // The key rotation task follows the new base time.
+    let next_rotation = wrapped.epoch_base_time.unwrap() + Duration::from_secs(3600);
+    let mut tries = 0;
+    while oprf_instance.read().unwrap().key_rotation_deadline != Some(next_rotation) {
+        assert!(tries < 10, "timeout waiting for key_rotation_loop restart");
+        tokio::time::sleep(pause).await;
+        tries += 1;
+    }
+    oprf_state.stop_background_tasks();
+}
+
+/// Confirm the remaining epoch count tracks puncturing,
+/// resetting when the key is rotated.
+#[tokio::test]
+async fn remaining_epochs() {
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    let oprf_instance = oprf_state.instances.get("main").unwrap();
+
+    let epoch_count = config.last_epoch - config.first_epoch + 1;
+    for advance in 0..=epoch_count {
+        let response = app.call(test_request("/info", None)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        // Count wraps back to the full range after exhaustion.
+        let expected = (epoch_count - 1) - advance % epoch_count;
+        assert_eq!(json["remainingEpochs"], json!(expected));
+
+        oprf_instance
+            .write()
+            .unwrap()
+            .advance_epoch(&config)
+            .unwrap();
+    }
+}
+
+/// Confirm identifiers on structured points are echoed
+/// alongside the matching outputs.
+#[tokio::test]
+async fn identified_points() {
+    let mut app = test_app(None);
+    let points = make_points(3);
+
+    let payload = json!({ "points": points }).to_string();
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let bare: Value = serde_json::from_slice(&body).unwrap();
+
+    let ids = ["first", "second", "third"];
+    let entries: Vec<_> = ids
+        .iter()
+        .zip(&points)
+        .map(|(id, point)| json!({ "id": id, "point": point }))
+        .collect();
+    let payload = json!({ "points": entries }).to_string();
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let identified: Value = serde_json::from_slice(&body).unwrap();
+
+    let bare = bare["points"].as_array().unwrap();
+    let identified = identified["points"].as_array().unwrap();
+    assert_eq!(identified.len(), ids.len());
+    for ((id, bare), entry) in ids.iter().zip(bare).zip(identified) {
+        assert_eq!(entry["id"], json!(id));
+        assert_eq!(&entry["point"], bare);
+    }
+
+    // Identified points are validated like bare ones.
+    let payload = json!({ "points": [{ "id": "bad", "point": "not a point" }] }).to_string();
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+/// Confirm requests for an epoch punctured out of band are
+/// reported as such, rather than as an evaluation failure.
+#[tokio::test]
+async fn punctured_epoch() {
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    let points = make_points(2);
+
+    // Puncture the current epoch without advancing.
+    let oprf_instance = oprf_state.instances.get("main").unwrap();
+    oprf_instance.write().unwrap().puncture(EPOCH).unwrap();
+
+    let payload = json!({ "points": points }).to_string();
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::GONE);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(
+        json["message"],
+        json!(format!("epoch {EPOCH} has been punctured"))
+    );
+}
+
+/// Wait for the epoch rotation task to publish its schedule
+async fn wait_for_schedule(oprf_state: &crate::state::OPRFState) {
+    let pause = Duration::from_millis(10);
+    let mut tries = 0;
+    for oprf_instance in oprf_state.instances.values() {
+        while oprf_instance.read().unwrap().schedule.is_none() {
+            assert!(tries < 10, "timeout waiting for epoch_loop initialization");
+            tokio::time::sleep(pause).await;
+            tries += 1;
+        }
+    }
+}
+
+#[tokio::test]
+async fn epoch_span() {
+    use time::format_description::well_known::Rfc3339;
+
+    let base = (OffsetDateTime::now_utc() - Duration::from_secs(5))
+        .replace_millisecond(0)
+        .unwrap();
+    let config = crate::Config {
+        epoch_base_time: Some(base),
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    oprf_state.start_background_tasks(&config).unwrap();
+    wait_for_schedule(&oprf_state).await;
+    let mut app = crate::app(oprf_state);
+
+    let span = |from: f64, to: f64| {
+        let from = (base + Duration::from_secs_f64(from)).format(&Rfc3339).unwrap();
+        let to = (base + Duration::from_secs_f64(to)).format(&Rfc3339).unwrap();
+        test_request(&format!("/epoch-span?from={from}&to={to}"), None)
+    };
+
+    // Range within a single sequence of epochs.
+    let response = app.call(span(2.5, 6.5)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["count"], json!(5));
+    let expected: Vec<u8> = (EPOCH + 2..=EPOCH + 6).collect();
+    assert_eq!(json["epochs"], json!(expected));
+
+    // Range wrapping around to the next key.
+    let response = app.call(span(12.5, 14.5)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["count"], json!(3));
+    assert_eq!(json["epochs"], json!([EPOCH * 2, EPOCH, EPOCH + 1]));
+
+    // Ranges before the base time, far in the future, or backwards
+    // are rejected.
+    let response = app.call(span(-1.0, 2.0)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let far = 400.0 * 86400.0;
+    let response = app.call(span(far, far + 2.0)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let response = app.call(span(3.0, 2.0)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn max_parse_time() {
+    let points = make_points(8);
+    let payload = json!({ "points": points }).to_string();
+
+    // A zero limit expires before the first point is decoded.
+    let config = crate::Config {
+        max_parse_time_ms: Some(0),
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    let request = test_request("/randomness", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+    assert_eq!(response.headers()[axum::http::header::RETRY_AFTER], "1");
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["message"], "Timed out decoding points");
+    let multi_payload = format!("[{payload}]");
+    let request = test_request("/randomness/multi", Some(multi_payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+    assert_eq!(response.headers()[axum::http::header::RETRY_AFTER], "1");
+    // Raw points are copied rather than decoded, so the limit
+    // doesn't apply to them.
+    let raw: Vec<u8> = points.iter().flat_map(|p| BASE64.decode(p).unwrap()).collect();
+    let request = Request::builder()
+        .uri("/randomness/raw")
+        .method("POST")
+        .body(Body::from(raw))
+        .unwrap();
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // A generous limit doesn't affect the result.
+    let config = crate::Config {
+        max_parse_time_ms: Some(60_000),
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    verify_randomness_body(&body, points.len());
+
+    // Points of the wrong length are rejected without decoding.
+    let mut points = make_points(2);
+    points[1].push_str("AAAA");
+    let payload = json!({ "points": points }).to_string();
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn max_request_bytes() {
+    let config = crate::Config {
+        max_request_bytes: 4096,
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+
+    // Info should report the configured limit.
+    let request = test_request("/info", None);
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["maxRequestBytes"], json!(4096));
+
+    // Requests within the limit are accepted.
+    let points = make_points(8);
+    let payload = json!({ "points": points }).to_string();
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // Requests over the limit are rejected.
+    let points = make_points(128);
+    let payload = json!({ "points": points }).to_string();
+    assert!(payload.len() > 4096);
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::PAYLOAD_TOO_LARGE);
+}
+
+#[tokio::test]
+async fn configured_max_points() {
+    let config = crate::Config {
+        max_points: 4,
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+
+    // Info should report the configured limit.
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["maxPoints"], json!(4));
+
+    let payload = json!({ "points": make_points(4) }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    let payload = json!({ "points": make_points(5) }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(
+        json["message"],
+        json!("Too many points for a single request: the limit is 4")
+    );
+}
+
+#[tokio::test]
+async fn schedule_pages() {
+    let config = crate::Config {
+        first_epoch: 0,
+        last_epoch: 255,
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+
+    // Page through the full listing.
+    let mut epochs = Vec::new();
+    let mut offset = Some(0);
+    while let Some(next) = offset {
+        let uri = format!("/schedule?offset={next}&limit=100");
+        let response = app.call(test_request(&uri, None)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["total"], json!(256));
+        let page = json["epochs"].as_array().unwrap();
+        assert!(!page.is_empty() && page.len() <= 100);
+        epochs.extend(page.iter().map(|e| e["epoch"].as_u64().unwrap()));
+        offset = json["nextOffset"].as_u64();
+    }
+    assert_eq!(epochs, (0..=255).collect::<Vec<u64>>());
+
+    // Check the default and maximum page sizes.
+    let response = app.call(test_request("/schedule", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["epochs"].as_array().unwrap().len(), 64);
+    assert_eq!(json["epochs"][0]["status"], json!("current"));
+    assert_eq!(json["epochs"][1]["status"], json!("upcoming"));
+    assert_eq!(json["nextOffset"], json!(64));
+    let request = test_request("/schedule?limit=1000", None);
+    let response = app.call(request).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["epochs"].as_array().unwrap().len(), 256);
+    assert_eq!(json["nextOffset"], Value::Null);
+    assert_eq!(json["truncated"], json!(true));
+
+    // An empty page isn't useful.
+    let request = test_request("/schedule?limit=0", None);
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn stale_epoch_loop() {
+    let points = make_points(4);
+    let payload = json!({ "points": points }).to_string();
+    let stall = |oprf_state: &crate::state::OPRFState, late: Duration| {
+        let deadline = OffsetDateTime::now_utc() - late;
+        for instance in oprf_state.instances.values() {
+            instance.write().unwrap().epoch_deadline = Some(deadline);
+        }
+    };
+
+    // By default a stalled rotation task doesn't affect requests.
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    stall(&oprf_state, Duration::from_secs(60));
+    let mut app = crate::app(oprf_state);
+    let request = test_request("/randomness", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    let config = crate::Config {
+        fail_closed_on_stale_loop: true,
+        ..test_config(None)
+    };
+    // Rotation a little late is within the bound.
+    let oprf_state = OPRFServer::new(&config);
+    stall(&oprf_state, Duration::from_secs(1));
+    let mut app = crate::app(oprf_state.clone());
+    let request = test_request("/randomness", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // Rotation beyond the bound fails closed.
+    stall(&oprf_state, Duration::from_secs(60));
+    let request = test_request("/randomness", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+    let request = test_request("/randomness/multi", Some(format!("[{payload}]")));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+}
+
+#[tokio::test]
+async fn info_cbor() {
+    let app = test_app(None);
+    let request = Request::builder()
+        .uri("/info")
+        .header("Accept", "application/cbor")
+        .body(Body::empty())
+        .unwrap();
+    let response = app.oneshot(request).await.unwrap();
+    let status = response.status();
+    assert_eq!(
+        response.headers()["Content-Type"],
+        crate::handler::CBOR_MEDIA_TYPE
+    );
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    // Fields should match the json response.
+    let json: Value = ciborium::from_reader(body.as_ref()).expect("Could not parse cbor body");
+    let body = Bytes::from(serde_json::to_vec(&json).unwrap());
+    validate_info_response_and_return_public_key_b64(status, body);
+}
+
+#[tokio::test]
+async fn max_schedule_entries() {
+    let config = crate::Config {
+        max_schedule_entries: 10,
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+
+    // Requests beyond the cap are clamped to it.
+    let request = test_request("/schedule?limit=100", None);
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["epochs"].as_array().unwrap().len(), 10);
+    assert_eq!(json["truncated"], json!(true));
+    assert_eq!(json["nextOffset"], json!(10));
+
+    // The default page size is clamped without being reported.
+    let response = app.call(test_request("/schedule", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["epochs"].as_array().unwrap().len(), 10);
+    assert_eq!(json["truncated"], json!(false));
+
+    // Requests within the cap are unaffected.
+    let request = test_request("/schedule?offset=2&limit=5", None);
+    let response = app.call(request).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["epochs"].as_array().unwrap().len(), 5);
+    assert_eq!(json["epochs"][0]["epoch"], json!(EPOCH + 2));
+    assert_eq!(json["truncated"], json!(false));
+}
+
+#[tokio::test]
+async fn readiness() {
+    // Without epoch rotation the server is never ready.
+    let app = test_app(None);
+    let response = app.oneshot(test_request("/readyz", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+
+    // With the first epoch in the near future, readiness should
+    // flip once it begins.
+    let config = crate::Config {
+        epoch_base_time: Some(OffsetDateTime::now_utc() + Duration::from_millis(300)),
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    oprf_state.start_background_tasks(&config).unwrap();
+    let mut app = crate::app(oprf_state);
+    let response = app.call(test_request("/readyz", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+
+    tokio::time::sleep(Duration::from_millis(500)).await;
+    let response = app.call(test_request("/readyz", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+}
+
+#[tokio::test]
+async fn include_epoch_times() {
+    use time::format_description::well_known::Rfc3339;
+
+    // Pin the clock well inside a long epoch, so no boundary passes
+    // between the requests.
+    let base = OffsetDateTime::parse(NEXT_EPOCH_TIME, &Rfc3339).unwrap();
+    let config = crate::Config {
+        epoch_durations: vec!["1h".into()],
+        epoch_base_time: Some(base),
+        ..test_config(None)
+    };
+    let now = base + Duration::from_secs(3 * 3600 + 1800);
+    let oprf_state = OPRFServer::with_clock(&config, std::sync::Arc::new(move || now));
+    oprf_state.start_background_tasks(&config).unwrap();
+    wait_for_schedule(&oprf_state).await;
+    let mut app = crate::app(oprf_state);
+    let points = make_points(2);
+
+    // Times are omitted by default.
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert!(json.get("epoch_start_time").is_none());
+    assert!(json.get("next_epoch_time").is_none());
+
+    let payload = json!({ "points": points, "include_epoch_times": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+
+    // Annotations should match the schedule reported by /info.
+    assert_eq!(json["epoch"], info["currentEpoch"]);
+    assert_eq!(json["next_epoch_time"], info["nextEpochTime"]);
+    let start = json["epoch_start_time"].as_str().unwrap();
+    let next = json["next_epoch_time"].as_str().unwrap();
+    let start = OffsetDateTime::parse(start, &Rfc3339).unwrap();
+    let next = OffsetDateTime::parse(next, &Rfc3339).unwrap();
+    assert_eq!(json["epoch"], EPOCH + 3);
+    assert_eq!(start, base + Duration::from_secs(3 * 3600));
+    assert_eq!(next, base + Duration::from_secs(4 * 3600));
+}
+
+#[tokio::test]
+async fn count_only() {
+    let mut app = test_app(None);
+    let mut points = make_points(3);
+    // Wrong length
+    points.push("AAAA".to_string());
+    // Right length, but not base64
+    points.push("!".repeat(44));
+    let payload = json!({ "points": points, "count_only": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["count"], json!(3));
+    assert_eq!(json["epoch"], json!(EPOCH));
+    assert!(json.get("points").is_none());
+
+    // Without count_only the invalid points fail the request.
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+
+    // Counts come without outputs to prove.
+    let payload = json!({ "points": points, "count_only": true, "verifiable": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["message"], "Proofs can't be returned when only counting points");
+}
+
+#[tokio::test]
+async fn epoch_jitter() {
+    use time::format_description::well_known::Rfc3339;
+
+    let base = (OffsetDateTime::now_utc() - Duration::from_secs(5))
+        .replace_millisecond(0)
+        .unwrap();
+    let mut base_times = Vec::new();
+    for server_id in ["server-a", "server-b"] {
+        let config = crate::Config {
+            epoch_base_time: Some(base),
+            server_id: Some(server_id.to_string()),
+            max_epoch_jitter_ms: 1000,
+            ..test_config(None)
+        };
+        let offset = crate::state::epoch_offset(server_id, 1000);
+        assert!(offset <= Duration::from_millis(1000));
+        assert_eq!(offset, crate::state::epoch_offset(server_id, 1000));
+
+        let oprf_state = OPRFServer::new(&config);
+        oprf_state.start_background_tasks(&config).unwrap();
+        wait_for_schedule(&oprf_state).await;
+        let schedule = oprf_state.instances["main"].read().unwrap().schedule.unwrap();
+        assert_eq!(schedule.base_time, base + offset);
+        base_times.push(schedule.base_time);
+
+        // The offset should be reported by /info.
+        let app = crate::app(oprf_state);
+        let response = app.oneshot(test_request("/info", None)).await.unwrap();
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["epochOffsetMs"], json!(offset.as_millis() as u64));
+        // Published boundaries keep the offset.
+        let next = json["nextEpochTime"].as_str().unwrap();
+        let next = OffsetDateTime::parse(next, &Rfc3339).unwrap();
+        assert_eq!(next.millisecond() as u128, offset.as_millis() % 1000);
+    }
+    // Different servers should have different epoch boundaries.
+    assert_ne!(base_times[0], base_times[1]);
+}
+
+#[tokio::test]
+async fn correlation_tokens() {
+    let mut app = test_app(None);
+    let points = make_points(3);
+
+    // Reference outputs for the bare points.
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let expected = json["points"].as_array().unwrap().clone();
+
+    // Tokens are arbitrary client metadata.
+    let tokens: Vec<String> = (0..points.len())
+        .map(|i| format!(r#"{{"row": {i}, "note": "any text"}}"#))
+        .collect();
+    let entries: Vec<Value> = points
+        .iter()
+        .zip(&tokens)
+        .map(|(point, token)| json!({ "token": token, "point": point }))
+        .collect();
+    let payload = json!({ "points": entries }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+
+    // Correlate by token alone, ignoring the response order.
+    let mut results = json["points"].as_array().unwrap().clone();
+    results.reverse();
+    for result in &results {
+        assert!(result.get("id").is_none());
+        let token = result["token"].as_str().unwrap();
+        let index = tokens.iter().position(|t| t == token).unwrap();
+        assert_eq!(result["point"], expected[index]);
+    }
+
+    // Token length is bounded.
+    let token = "x".repeat(257);
+    let payload = json!({ "points": [{ "token": token, "point": points[0] }] }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+#[test]
+fn latency_window() {
+    let mut window = crate::state::LatencyWindow::new(100);
+    assert!(window.percentiles([50]).is_none());
+    // Record more than fit, so the first samples are dropped.
+    for ms in 1..=150 {
+        window.record(Duration::from_millis(ms));
+    }
+    assert_eq!(window.sample_count(), 100);
+    let [min, p50, p95, p99, max] = window.percentiles([0, 50, 95, 99, 100]).unwrap();
+    assert_eq!(min, Duration::from_millis(51));
+    assert_eq!(p50, Duration::from_millis(100));
+    assert_eq!(p95, Duration::from_millis(145));
+    assert_eq!(p99, Duration::from_millis(149));
+    assert_eq!(max, Duration::from_millis(150));
+}
+
+/// Confirm a list of epoch durations may be given in one value,
+/// as the environment variable requires
+#[test]
+fn epoch_duration_list() {
+    use clap::Parser;
+
+    let config = crate::Config::parse_from([
+        "star-randsrv",
+        "--instance-name",
+        "a",
+        "--instance-name",
+        "b",
+        "--epoch-duration",
+        "1d,5s",
+    ]);
+    let expected = calendar_duration::CalendarDuration::from("5s");
+    assert_eq!(config.epoch_durations.len(), 2);
+    assert_eq!(config.epoch_durations[1].to_string(), expected.to_string());
+}
+
+#[tokio::test]
+async fn expose_latency() {
+    // Latency isn't reported by default.
+    let app = test_app(None);
+    let response = app.oneshot(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert!(json.get("latency").is_none());
+
+    let config = crate::Config {
+        expose_latency: true,
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    for count in [1, 10, 100] {
+        let payload = json!({ "points": make_points(count) }).to_string();
+        let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+    }
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let latency = &json["latency"];
+    assert_eq!(latency["samples"], json!(3));
+    let p50 = latency["p50Micros"].as_u64().unwrap();
+    let p95 = latency["p95Micros"].as_u64().unwrap();
+    let p99 = latency["p99Micros"].as_u64().unwrap();
+    assert!(p50 <= p95 && p95 <= p99);
+}
+
+/// Confirm every randomness request is counted with its outcome
+#[test]
+fn request_counts() {
+    let recorder = CountingRecorder::default();
+    // The local recorder only sees metrics recorded on this thread,
+    // so serve the requests from a runtime on it.
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .unwrap();
+    metrics::with_local_recorder(&recorder, || {
+        runtime.block_on(async {
+            let mut app = test_app(None);
+            let payload = json!({ "points": make_points(2) }).to_string();
+            for _ in 0..2 {
+                let request = test_request("/randomness", Some(payload.clone()));
+                let response = app.call(request).await.unwrap();
+                assert_eq!(response.status(), StatusCode::OK);
+            }
+            let request = test_request("/instances/main/randomness", Some("{".to_string()));
+            let response = app.call(request).await.unwrap();
+            assert!(response.status().is_client_error());
+            for name in ["missing", "other"] {
+                let uri = format!("/instances/{name}/randomness");
+                let request = test_request(&uri, Some(payload.clone()));
+                let response = app.call(request).await.unwrap();
+                assert_eq!(response.status(), StatusCode::NOT_FOUND);
+            }
+        })
+    });
+    let count = |labels: &str| recorder.count(&format!("randomness_requests_total{{{labels}}}"));
+    assert_eq!(count("instance=main,outcome=ok"), 2);
+    assert_eq!(count("instance=main,outcome=rejected"), 1);
+    // Unknown instances share a single label.
+    assert_eq!(count("instance=unknown,outcome=rejected"), 2);
+    assert_eq!(count("instance=missing,outcome=rejected"), 0);
+}
+
+/// Confirm a poisoned latency window doesn't fail requests
+#[tokio::test]
+async fn latency_poisoned() {
+    let config = crate::Config {
+        expose_latency: true,
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    let server = oprf_state.clone();
+    std::thread::spawn(move || {
+        let _window = server.latency.as_ref().unwrap().lock().unwrap();
+        panic!("poison the latency window");
+    })
+    .join()
+    .unwrap_err();
+
+    let mut app = crate::app(oprf_state);
+    let payload = json!({ "points": make_points(2) }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    verify_randomness_body(&body, 2);
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+}
+
+#[tokio::test]
+async fn raw_randomness() {
+    let mut app = test_app(None);
+    let points = make_points(3);
+
+    // Reference outputs from the json endpoint.
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let expected: Vec<u8> = json["points"]
+        .as_array()
+        .unwrap()
+        .iter()
+        .flat_map(|p| BASE64.decode(p.as_str().unwrap()).unwrap())
+        .collect();
+
+    let raw: Vec<u8> = points.iter().flat_map(|p| BASE64.decode(p).unwrap()).collect();
+    let request = Request::builder()
+        .uri("/randomness/raw")
+        .method("POST")
+        .header("Content-Type", "application/octet-stream")
+        .body(Body::from(raw.clone()))
+        .unwrap();
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    assert_eq!(response.headers()["Content-Type"], "application/octet-stream");
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    // Epoch byte, big-endian count, then the output points.
+    assert_eq!(body.len(), 1 + 4 + 3 * 32);
+    assert_eq!(body[0], EPOCH);
+    assert_eq!(&body[1..5], &[0, 0, 0, 3]);
+    assert_eq!(&body[5..], expected.as_slice());
+
+    // Bodies must hold whole points.
+    let request = Request::builder()
+        .uri("/randomness/raw")
+        .method("POST")
+        .body(Body::from(raw[..40].to_vec()))
+        .unwrap();
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn status() {
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+
+    // Nothing is known until the schedule is running.
+    let response = app.call(test_request("/status", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["currentEpoch"], json!(EPOCH));
+    assert_eq!(json["secondsUntilKeyChange"], Value::Null);
+
+    // Pretend the schedule started, with an hour left in the first epoch.
+    let now = OffsetDateTime::now_utc();
+    {
+        let mut instance = oprf_state.instances["main"].write().unwrap();
+        instance.schedule = Some(crate::state::EpochSchedule {
+            base_time: now,
+            epoch_duration: "1h".into(),
+        });
+        instance.epoch_deadline = Some(now + Duration::from_secs(3600));
+    }
+    let mut remaining = Vec::new();
+    for _ in 0..3 {
+        let response = app.call(test_request("/status", None)).await.unwrap();
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert!(json["nextKeyChangeTime"].is_string());
+        remaining.push((
+            json["remainingEpochs"].as_u64().unwrap(),
+            json["secondsUntilKeyChange"].as_i64().unwrap(),
+        ));
+        // Puncture the current epoch, keeping the same deadline.
+        oprf_state.instances["main"]
+            .write()
+            .unwrap()
+            .advance_epoch(&config)
+            .unwrap();
+    }
+    // Each punctured epoch brings the key change an hour closer.
+    let hours = (EPOCH * 2 - EPOCH) as i64 + 1;
+    assert!(remaining[0].1 <= hours * 3600 && remaining[0].1 > hours * 3600 - 60);
+    for pair in remaining.windows(2) {
+        assert_eq!(pair[1].0, pair[0].0 - 1);
+        assert!(pair[1].1 < pair[0].1);
+        assert!(pair[0].1 - pair[1].1 >= 3599);
+    }
+
+    // Periodic key rotation takes effect if sooner.
+    oprf_state.instances["main"].write().unwrap().key_rotation_deadline =
+        Some(now + Duration::from_secs(600));
+    let response = app.call(test_request("/status", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert!(json["secondsUntilKeyChange"].as_i64().unwrap() <= 600);
+}
+
+#[tokio::test]
+async fn pause_and_resume() {
+    let path = std::env::temp_dir().join(format!("star-randsrv-admin-{}", std::process::id()));
+    std::fs::write(&path, "s3cret\n").unwrap();
+    let config = crate::Config {
+        admin_token_file: Some(path.clone()),
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    std::fs::remove_file(&path).unwrap();
+
+    let admin = |uri: &str, token: Option<&str>| {
+        let mut builder = Request::builder().uri(uri).method("POST");
+        if let Some(token) = token {
+            builder = builder.header("Authorization", format!("Bearer {token}"));
+        }
+        builder.body(Body::empty()).unwrap()
+    };
+    let payload = json!({ "points": make_points(2) }).to_string();
+
+    // Admin requests must be authenticated.
+    let response = app.call(admin("/admin/pause", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+    let response = app.call(admin("/admin/pause", Some("wrong"))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+    let request = test_request("/randomness", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // Pausing stops randomness, but not info or status.
+    let response = app.call(admin("/admin/pause", Some("s3cret"))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::NO_CONTENT);
+    let request = test_request("/randomness", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let response = app.call(test_request("/status", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["paused"], json!(true));
+
+    // Resuming restores service.
+    let response = app.call(admin("/admin/resume", Some("s3cret"))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::NO_CONTENT);
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let response = app.call(test_request("/status", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["paused"], json!(false));
+
+    // Without a token the admin endpoints don't exist.
+    let mut app = test_app(None);
+    let response = app.call(admin("/admin/pause", Some("s3cret"))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::NOT_FOUND);
+}
+
+#[tokio::test]
+async fn shuffle_seed() {
+    use sha2::Digest;
+
+    let mut app = test_app(None);
+    let points = make_points(4);
+    let mut seeds = Vec::new();
+    for order in [[0, 1, 2, 3], [3, 1, 0, 2]] {
+        let batch: Vec<_> = order.iter().map(|&i| &points[i]).collect();
+        let payload = json!({ "points": batch, "include_shuffle_seed": true }).to_string();
+        let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        seeds.push(json["shuffle_seed"].as_str().unwrap().to_string());
+    }
+    // The seed doesn't depend on the order of the batch.
+    assert_eq!(seeds[0], seeds[1]);
+
+    // Recompute the seed from the documented derivation.
+    let mut inputs: Vec<Vec<u8>> = points.iter().map(|p| BASE64.decode(p).unwrap()).collect();
+    inputs.sort();
+    let mut hasher = Sha256::new();
+    hasher.update(crate::handler::SHUFFLE_SEED_DOMAIN);
+    hasher.update([EPOCH]);
+    for input in inputs {
+        hasher.update(input);
+    }
+    assert_eq!(seeds[0], BASE64.encode(hasher.finalize()));
+
+    // No seed unless requested.
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert!(json.get("shuffle_seed").is_none());
+}
+
+#[tokio::test]
+async fn require_distinct() {
+    let mut app = test_app(None);
+    let mut points = make_points(3);
+    points.push(points[1].clone());
+
+    // Duplicates are evaluated by default.
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    verify_randomness_body(&body, points.len());
+
+    // They're rejected on request, naming the first repeat.
+    let payload = json!({ "points": points, "require_distinct": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::UNPROCESSABLE_ENTITY);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert!(json["message"].as_str().unwrap().contains("Point 3"));
+
+    // Distinct points are unaffected.
+    points.pop();
+    let payload = json!({ "points": points, "require_distinct": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+}
+
+#[tokio::test]
+async fn key_commitment() {
+    use sha2::Digest;
+
+    let mut app = test_app(None);
+    let payload = json!({ "points": make_points(2), "include_key_commitment": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let commitment = json["key_commitment"].as_str().unwrap();
+
+    // Recompute the commitment from the published public key.
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    let public_key = BASE64.decode(info["publicKey"].as_str().unwrap()).unwrap();
+    let mut hasher = Sha256::new();
+    hasher.update(crate::handler::KEY_COMMITMENT_DOMAIN);
+    hasher.update(public_key);
+    assert_eq!(commitment, BASE64.encode(hasher.finalize()));
+}
+
+#[test]
+fn eval_cache_eviction() {
+    let point = |i: u8| ppoprf::ppoprf::Point::from([i; 32].as_slice());
+    let mut cache = crate::state::EvalCache::new(2);
+    cache.insert(point(1), point(11));
+    cache.insert(point(2), point(12));
+    assert_eq!(cache.get(&point(1)), Some(point(11)));
+    // The least recently used entry is evicted.
+    cache.insert(point(3), point(13));
+    assert_eq!(cache.get(&point(2)), None);
+    assert_eq!(cache.get(&point(1)), Some(point(11)));
+    assert_eq!(cache.get(&point(3)), Some(point(13)));
+    cache.clear();
+    assert_eq!(cache.get(&point(1)), None);
+}
+
+/// Confirm a batch spread across threads is evaluated in order
+#[test]
+fn eval_parallel() {
+    use ppoprf::ppoprf::Point;
+
+    let config = crate::Config {
+        eval_threads: Some(4),
+        ..test_config(None)
+    };
+    let pool = crate::state::eval_pool(&config);
+    let mut instance = crate::state::OPRFInstance::new(&config, pool).unwrap();
+    let points: Vec<Point> = make_points(300)
+        .iter()
+        .map(|p| Point::from(BASE64.decode(p).unwrap().as_slice()))
+        .collect();
+    let outputs = |instance: &crate::state::OPRFInstance| -> Vec<Point> {
+        instance
+            .eval_parallel(&points, EPOCH, false, None)
+            .unwrap()
+            .into_iter()
+            .map(|evaluation| evaluation.unwrap().output)
+            .collect()
+    };
+    let parallel = outputs(&instance);
+    let pool = instance.eval_pool.take();
+    assert_eq!(parallel, outputs(&instance));
+
+    // Failures are reported in place.
+    instance.eval_pool = pool;
+    instance.puncture(EPOCH).unwrap();
+    let results = instance.eval_parallel(&points, EPOCH, false, None).unwrap();
+    assert_eq!(results.len(), points.len());
+    assert!(results.iter().all(|result| result.is_err()));
+}
+
+/// Confirm repeated points are served from the evaluation cache
+#[test]
+fn eval_cache_hits() {
+    use ppoprf::ppoprf::Point;
+
+    let config = crate::Config {
+        eval_cache_size: 16,
+        ..test_config(None)
+    };
+    let pool = crate::state::eval_pool(&config);
+    let instance = crate::state::OPRFInstance::new(&config, pool).unwrap();
+    let points: Vec<Point> = make_points(4)
+        .iter()
+        .map(|p| Point::from(BASE64.decode(p).unwrap().as_slice()))
+        .collect();
+    let recorder = CountingRecorder::default();
+    let (first, second) = metrics::with_local_recorder(&recorder, || {
+        let first = instance.eval(&points[..2], EPOCH, false, None).unwrap();
+        let second = instance.eval(&points, EPOCH, false, None).unwrap();
+        (first, second)
+    });
+    assert_eq!(recorder.count("eval_cache_hits_total{}"), 2);
+    assert_eq!(recorder.count("eval_cache_misses_total{}"), 4);
+    assert_eq!(first[0].output, second[0].output);
+    assert_eq!(first[1].output, second[1].output);
+
+    // Verifiable evaluations bypass the cache.
+    metrics::with_local_recorder(&recorder, || instance.eval(&points, EPOCH, true, None).unwrap());
+    assert_eq!(recorder.count("eval_cache_hits_total{}"), 2);
+}
+
+/// Confirm the evaluation pool speeds up a large batch
+#[test]
+fn eval_parallel_speedup() {
+    use ppoprf::ppoprf::Point;
+
+    if std::thread::available_parallelism().map_or(1, |n| n.get()) < 2 {
+        eprintln!("skipping: needs at least two CPUs");
+        return;
+    }
+    let config = crate::Config {
+        eval_threads: Some(2),
+        ..test_config(None)
+    };
+    let pool = crate::state::eval_pool(&config);
+    let mut instance = crate::state::OPRFInstance::new(&config, pool).unwrap();
+    let points: Vec<Point> = make_points(2000)
+        .iter()
+        .map(|p| Point::from(BASE64.decode(p).unwrap().as_slice()))
+        .collect();
+    // Take the best of a few runs to ride out scheduling noise.
+    let time = |instance: &crate::state::OPRFInstance| {
+        (0..3)
+            .map(|_| {
+                let start = std::time::Instant::now();
+                instance.eval_parallel(&points, EPOCH, false, None);
+                start.elapsed()
+            })
+            .min()
+            .unwrap()
+    };
+    let parallel = time(&instance);
+    instance.eval_pool = None;
+    let sequential = time(&instance);
+    assert!(
+        parallel < sequential.mul_f64(0.8),
+        "parallel {parallel:?} should beat sequential {sequential:?}"
+    );
+}
+
+#[tokio::test]
+async fn eval_cache() {
+    let config = crate::Config {
+        eval_cache_size: 16,
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    let payload = json!({ "points": make_points(4) }).to_string();
+    let mut outputs = Vec::new();
+    for _ in 0..2 {
+        let request = test_request("/randomness", Some(payload.clone()));
+        let response = app.call(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        verify_randomness_body(&body, 4);
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        outputs.push(json["points"].clone());
+    }
+    // Cached outputs should match the evaluated ones.
+    assert_eq!(outputs[0], outputs[1]);
+    let cache_entries = |mut app: crate::Router| async move {
+        let response = app.call(test_request("/status", None)).await.unwrap();
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let status: Value = serde_json::from_slice(&body).unwrap();
+        status["evalCacheEntries"].clone()
+    };
+    assert_eq!(cache_entries(app.clone()).await, 4);
+
+    // Rotating the key should invalidate the cache.
+    oprf_state.instances["main"]
+        .write()
+        .unwrap()
+        .rotate_key(&config)
+        .unwrap();
+    assert_eq!(cache_entries(app.clone()).await, 0);
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_ne!(json["points"], outputs[0]);
+}
+
+/// Fetch the public key published by `/info`
+async fn fetch_public_key(app: &mut axum::Router) -> ppoprf::ppoprf::ServerPublicKey {
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(info["proofsSupported"], true);
+    let public_key = BASE64.decode(info["publicKey"].as_str().unwrap()).unwrap();
+    ppoprf::ppoprf::ServerPublicKey::load_from_bincode(&public_key).unwrap()
+}
+
+/// Check each output in a verifiable response against its proof
+fn verify_proofs(
+    body: &Bytes,
+    points: &[String],
+    public_key: &ppoprf::ppoprf::ServerPublicKey,
+) {
+    use ppoprf::ppoprf::{Client, Evaluation, Point, ProofDLEQ};
+
+    verify_randomness_body(body, points.len());
+    let json: Value = serde_json::from_slice(body).unwrap();
+    let epoch = json["epoch"].as_u64().unwrap() as u8;
+    let outputs = json["points"].as_array().unwrap();
+    let proofs = json["proofs"].as_array().unwrap();
+    assert_eq!(proofs.len(), points.len());
+    for ((input, output), proof) in points.iter().zip(outputs).zip(proofs) {
+        let input = Point::from(BASE64.decode(input).unwrap().as_slice());
+        let output = Point::from(BASE64.decode(output.as_str().unwrap()).unwrap().as_slice());
+        let proof = BASE64.decode(proof.as_str().unwrap()).unwrap();
+        assert!(!proof.is_empty());
+        let evaluation = Evaluation {
+            output,
+            proof: Some(ProofDLEQ::load_from_bincode(&proof).unwrap()),
+        };
+        assert!(Client::verify(public_key, &input, &evaluation, epoch));
+    }
+}
+
+#[tokio::test]
+async fn verifiable_randomness() {
+    let mut app = test_app(None);
+    let public_key = fetch_public_key(&mut app).await;
+
+    let points = make_points(3);
+    let payload = json!({ "points": points, "verifiable": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    verify_proofs(&body, &points, &public_key);
+
+    // Non-verifiable responses are unchanged.
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert!(json.get("proofs").is_none());
+
+    // Proofs can't be combined with HKDF output.
+    let payload = json!({
+        "points": points,
+        "verifiable": true,
+        "hkdf": { "salt": BASE64.encode(b"salt"), "length": 32 },
+    })
+    .to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn proof_indices() {
+    use ppoprf::ppoprf::{Client, Evaluation, Point, ProofDLEQ};
+
+    let mut app = test_app(None);
+    let public_key = fetch_public_key(&mut app).await;
+    let points = make_points(4);
+    let payload = json!({ "points": points, "verifiable": true, "proof_indices": [2, 0] });
+    let response = app
+        .call(test_request("/randomness", Some(payload.to_string())))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    verify_randomness_body(&body, points.len());
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let epoch = json["epoch"].as_u64().unwrap() as u8;
+    let outputs = json["points"].as_array().unwrap();
+    let proofs = json["proofs"].as_array().unwrap();
+    // Proofs come back only for the requested points, in request order.
+    assert_eq!(json["proof_indices"], json!([0, 2]));
+    assert_eq!(proofs.len(), 2);
+    for (&index, proof) in [0, 2].iter().zip(proofs) {
+        let input = Point::from(BASE64.decode(&points[index]).unwrap().as_slice());
+        let output = BASE64.decode(outputs[index].as_str().unwrap()).unwrap();
+        let proof = BASE64.decode(proof.as_str().unwrap()).unwrap();
+        let evaluation = Evaluation {
+            output: Point::from(output.as_slice()),
+            proof: Some(ProofDLEQ::load_from_bincode(&proof).unwrap()),
+        };
+        assert!(Client::verify(&public_key, &input, &evaluation, epoch));
+    }
+
+    // The unproven outputs match a plain evaluation.
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let plain: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(plain["points"].as_array().unwrap(), outputs);
+    assert!(plain.get("proof_indices").is_none());
+
+    // Indices must be in range, and need a verifiable request.
+    for payload in [
+        json!({ "points": points, "verifiable": true, "proof_indices": [4] }),
+        json!({ "points": points, "proof_indices": [0] }),
+    ] {
+        let response = app
+            .call(test_request("/randomness", Some(payload.to_string())))
+            .await
+            .unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    }
+}
+
+#[tokio::test]
+async fn both_outputs() {
+    let config = crate::Config {
+        max_verifiable_points: 3,
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    let public_key = fetch_public_key(&mut app).await;
+    let points = make_points(3);
+    let payload = json!({ "points": points, "verifiable": true, "both": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    verify_proofs(&body, &points, &public_key);
+    // The outputs with and without proofs are identical.
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["unproven_points"], json["points"]);
+
+    // Both outputs need a verifiable request.
+    let payload = json!({ "points": points, "both": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+
+    // Proofs are bounded by the verifiable point limit, though
+    // other points may be evaluated alongside.
+    let points = make_points(4);
+    let payload = json!({ "points": points, "verifiable": true, "both": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let error: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(error["message"], "Too many proofs for a single request: the limit is 3");
+    let payload = json!({ "points": points, "verifiable": true, "proof_indices": [0, 1, 2] });
+    let response = app
+        .call(test_request("/randomness", Some(payload.to_string())))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // The limit covers a whole batch.
+    let request = json!({ "points": make_points(2), "verifiable": true });
+    let payload = json!([request, request]).to_string();
+    let response = app.call(test_request("/randomness/multi", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let request = json!({ "points": make_points(2), "verifiable": true, "proof_indices": [1, 1] });
+    let payload = json!([request, request]).to_string();
+    let response = app.call(test_request("/randomness/multi", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+}
+
+/// Confirm proofs remain valid as epochs are punctured
+#[tokio::test]
+async fn verifiable_after_puncture() {
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    let public_key = fetch_public_key(&mut app).await;
+    let oprf_instance = oprf_state.instances.get("main").unwrap();
+    let points = make_points(2);
+
+    for epoch in EPOCH..EPOCH + 3 {
+        let payload = json!({ "points": points, "epoch": epoch, "verifiable": true }).to_string();
+        let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        verify_proofs(&body, &points, &public_key);
+
+        oprf_instance
+            .write()
+            .unwrap()
+            .advance_epoch(&config)
+            .unwrap();
+    }
+}
+
+#[tokio::test]
+async fn verify_endpoint() {
+    let mut app = test_app(None);
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    let public_key = info["publicKey"].as_str().unwrap();
+
+    let points = make_points(2);
+    let payload = json!({ "points": points, "verifiable": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let outputs = json["points"].as_array().unwrap();
+    let proofs = json["proofs"].as_array().unwrap();
+
+    let mut check = |output: &Value, input: &str| {
+        let payload = json!({
+            "input": input,
+            "output": output,
+            "proof": proofs[0],
+            "epoch": json["epoch"],
+            "public_key": public_key,
+        })
+        .to_string();
+        app.call(test_request("/verify", Some(payload)))
+    };
+    let response = check(&outputs[0], &points[0]).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let result: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(result["valid"], true);
+
+    // The proof doesn't hold for another output.
+    let response = check(&outputs[1], &points[0]).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let result: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(result["valid"], false);
+
+    // Malformed points are rejected.
+    let response = check(&outputs[0], "not a point").await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+
+    // Proofs may be checked in CBOR too.
+    let payload = json!({
+        "input": points[0],
+        "output": outputs[0],
+        "proof": proofs[0],
+        "epoch": json["epoch"],
+        "public_key": public_key,
+    });
+    let mut body = Vec::new();
+    ciborium::into_writer(&payload, &mut body).unwrap();
+    let request = Request::builder()
+        .uri("/verify")
+        .method("POST")
+        .header("Content-Type", "application/cbor")
+        .header("Accept", "application/cbor")
+        .body(Body::from(body))
+        .unwrap();
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let result: Value = ciborium::from_reader(body.as_ref()).unwrap();
+    assert_eq!(result["valid"], true);
+}
+
+/// Confirm a hex-encoded verifiable response can be passed
+/// straight back to /verify
+#[tokio::test]
+async fn verify_hex() {
+    let mut app = test_app(None);
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+
+    let points: Vec<String> = make_points(2)
+        .iter()
+        .map(|p| BASE64.decode(p).unwrap().iter().map(|b| format!("{b:02x}")).collect())
+        .collect();
+    let payload = json!({ "points": points, "verifiable": true, "encoding": "hex" });
+    let response = app
+        .call(test_request("/randomness", Some(payload.to_string())))
+        .await
+        .unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let tuples: Vec<Value> = (0..points.len())
+        .map(|index| {
+            json!({
+                "input": points[index],
+                "output": json["points"][index],
+                "proof": json["proofs"][index],
+                "epoch": json["epoch"],
+                "public_key": info["publicKey"],
+                "encoding": "hex",
+            })
+        })
+        .collect();
+
+    let response = app
+        .call(test_request("/verify", Some(tuples[0].to_string())))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let result: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(result["valid"], true);
+
+    let payload = Value::from(tuples.clone()).to_string();
+    let response = app.call(test_request("/verify/multi", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let results: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(results, json!([{ "valid": true }, { "valid": true }]));
+
+    // Hex values must be declared as such.
+    let mut tuple = tuples[0].clone();
+    tuple.as_object_mut().unwrap().remove("encoding");
+    let response = app.call(test_request("/verify", Some(tuple.to_string()))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+/// Confirm tuples from different key generations can be checked
+/// in one call
+#[tokio::test]
+async fn verify_generations() {
+    let config = crate::Config {
+        max_verifiable_points: 2,
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    let points = make_points(1);
+
+    let mut tuples = Vec::new();
+    for generation in 0..2 {
+        let payload = json!({ "points": points, "verifiable": true }).to_string();
+        let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        tuples.push(json!({
+            "input": points[0],
+            "output": json["points"][0],
+            "proof": json["proofs"][0],
+            "epoch": json["epoch"],
+            "generation": generation,
+        }));
+        oprf_state.instances["main"]
+            .write()
+            .unwrap()
+            .rotate_key(&config)
+            .unwrap();
+    }
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    let generations: Vec<_> = info["keyHistory"]
+        .as_array()
+        .unwrap()
+        .iter()
+        .map(|key| key["generation"].as_u64().unwrap())
+        .collect();
+    assert_eq!(generations, [0, 1, 2]);
+
+    let mut check = |tuples: &[Value]| {
+        let payload = Value::from(tuples).to_string();
+        app.call(test_request("/verify/multi", Some(payload)))
+    };
+    let response = check(&tuples).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let results: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(results, json!([{ "valid": true }, { "valid": true }]));
+
+    // Each proof holds only for its own generation's key.
+    let mut swapped = tuples.clone();
+    swapped[0]["generation"] = json!(1);
+    let response = check(&swapped).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let results: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(results, json!([{ "valid": false }, { "valid": true }]));
+
+    // Generations no longer retained are reported against the tuple.
+    let mut missing = tuples.clone();
+    missing[1]["generation"] = json!(7);
+    let response = check(&missing).await.unwrap();
+    assert_eq!(response.status(), StatusCode::GONE);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let error: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(error["index"], 1);
+    assert_eq!(error["message"], "Key generation 7 is not retained");
+
+    // A tuple names either a key or a generation.
+    let mut both = tuples.clone();
+    both[0]["public_key"] = info["publicKey"].clone();
+    let response = check(&both).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+
+    // Batches are bounded by the verifiable point limit.
+    let mut more = tuples.clone();
+    more.push(tuples[0].clone());
+    let response = check(&more).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let error: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(error["message"], "Too many proofs for a single request: the limit is 2");
+}
+
+#[tokio::test]
+async fn include_public_key() {
+    let mut app = test_app(None);
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+
+    let payload = json!({ "points": make_points(1), "include_public_key": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["public_key"], info["publicKey"]);
+
+    // The key is only included on request.
+    let payload = json!({ "points": make_points(1) }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert!(json.get("public_key").is_none());
+}
+
+/// Confirm a zero epoch length is reported rather than
+/// leaving the epoch rotation task spinning.
+#[tokio::test]
+async fn zero_epoch_duration() {
+    let config = crate::Config {
+        epoch_durations: vec!["0s".into()],
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    assert!(matches!(
+        oprf_state.start_background_tasks(&config),
+        Err(crate::state::ScheduleError::ZeroDuration)
+    ));
+
+    let config = crate::Config {
+        key_rotation_interval: Some("0s".into()),
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    assert!(matches!(
+        oprf_state.start_background_tasks(&config),
+        Err(crate::state::ScheduleError::ZeroRotationInterval)
+    ));
+}
+
+#[tokio::test]
+async fn health() {
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+
+    let response = app.call(test_request("/healthz", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json, json!({ "status": "ok" }));
+
+    // An instance which can't evaluate is reported as unhealthy.
+    let oprf_instance = oprf_state.instances.get("main").unwrap();
+    oprf_instance.write().unwrap().puncture(EPOCH).unwrap();
+    let response = app.call(test_request("/healthz", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["status"], "unavailable");
+    assert!(json["reason"].as_str().unwrap().contains("main"));
+}
+
+/// Confirm stopping the background tasks releases the server state
+#[tokio::test(start_paused = true)]
+async fn stop_background_tasks() {
+    let config = crate::Config {
+        key_rotation_interval: Some("1h".into()),
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    oprf_state.start_background_tasks(&config).unwrap();
+    wait_for_schedule(&oprf_state).await;
+    assert!(std::sync::Arc::strong_count(&oprf_state) > 1);
+
+    oprf_state.stop_background_tasks();
+    let pause = Duration::from_millis(10);
+    let mut tries = 0;
+    while std::sync::Arc::strong_count(&oprf_state) > 1 {
+        assert!(tries < 10, "timeout waiting for background tasks to stop");
+        tokio::time::sleep(pause).await;
+        tries += 1;
+    }
+}
+
+/// Confirm each epoch is punctured as it ends, and only then
+#[tokio::test]
+async fn epochs_punctured_in_order() {
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    oprf_state.start_background_tasks(&config).unwrap();
+    wait_for_schedule(&oprf_state).await;
+    let oprf_instance = oprf_state.instances.get("main").unwrap();
+
+    let start_epoch = oprf_instance.read().unwrap().epoch;
+    let pause = Duration::from_millis(50);
+    let mut tries = 0;
+    let mut epoch = start_epoch;
+    while epoch < start_epoch + 2 {
+        assert!(tries < 60, "timeout waiting for epoch advance");
+        tokio::time::sleep(pause).await;
+        tries += 1;
+        let state = oprf_instance.read().unwrap();
+        // Every earlier epoch, and none later, is punctured.
+        let expected: std::collections::HashSet<u8> = (config.first_epoch..state.epoch).collect();
+        assert_eq!(state.punctured, expected);
+        epoch = state.epoch;
+    }
+}
+
+#[tokio::test]
+async fn strict_json() {
+    let payload = json!({ "points": make_points(1), "epic": EPOCH }).to_string();
+
+    // Unknown fields are ignored by default.
+    let mut app = test_app(None);
+    let request = test_request("/randomness", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    let config = crate::Config {
+        strict_json: true,
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    let requests = [
+        test_request("/randomness", Some(payload.clone())),
+        // Batched requests are checked the same way.
+        test_request("/randomness/multi", Some(format!("[{payload}]"))),
+    ];
+    for request in requests {
+        let response = app.call(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert!(json["message"].as_str().unwrap().contains("unknown field `epic`"));
+    }
+
+    // Known fields are still accepted.
+    let payload = json!({ "points": make_points(1), "epoch": EPOCH }).to_string();
+    let request = test_request("/randomness", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let request = test_request("/randomness/multi", Some(format!("[{payload}]")));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // Other data errors keep their usual status.
+    let payload = json!({ "points": make_points(1), "epoch": "now" }).to_string();
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::UNPROCESSABLE_ENTITY);
+}
+
+#[tokio::test]
+async fn gzip() {
+    use flate2::{read::GzDecoder, write::GzEncoder, Compression};
+    use std::io::{Read, Write};
+
+    let points = make_points(64);
+    let payload = json!({ "points": points }).to_string();
+    let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+    encoder.write_all(payload.as_bytes()).unwrap();
+    let compressed = encoder.finish().unwrap();
+
+    let request = Request::builder()
+        .uri("/randomness")
+        .method("POST")
+        .header("Content-Type", "application/json")
+        .header("Content-Encoding", "gzip")
+        .header("Accept-Encoding", "gzip")
+        .body(Body::from(compressed))
+        .unwrap();
+    let response = test_app(None).oneshot(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    assert_eq!(response.headers()["content-encoding"], "gzip");
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let mut decompressed = Vec::new();
+    GzDecoder::new(body.as_ref())
+        .read_to_end(&mut decompressed)
+        .unwrap();
+    verify_randomness_body(&decompressed.into(), points.len());
+}
+
+#[tokio::test]
+async fn randomness_cbor() {
+    let points = make_points(3);
+    let mut payload = Vec::new();
+    ciborium::into_writer(&json!({ "points": points }), &mut payload).unwrap();
+    let request = Request::builder()
+        .uri("/randomness")
+        .method("POST")
+        .header("Content-Type", "application/cbor")
+        .header("Accept", "application/cbor")
+        .body(Body::from(payload))
+        .unwrap();
+    let response = test_app(None).oneshot(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    assert_eq!(
+        response.headers()["Content-Type"],
+        crate::handler::CBOR_MEDIA_TYPE
+    );
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = ciborium::from_reader(body.as_ref()).expect("Could not parse cbor body");
+    verify_randomness_body(&serde_json::to_vec(&json).unwrap().into(), points.len());
+
+    // Malformed CBOR is the client's fault.
+    let request = Request::builder()
+        .uri("/randomness")
+        .method("POST")
+        .header("Content-Type", "application/cbor")
+        .body(Body::from(vec![0xff]))
+        .unwrap();
+    let response = test_app(None).oneshot(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+
+    // Batches may be encoded the same way.
+    let mut payload = Vec::new();
+    ciborium::into_writer(&json!([{ "points": points }, { "points": points }]), &mut payload)
+        .unwrap();
+    let request = Request::builder()
+        .uri("/randomness/multi")
+        .method("POST")
+        .header("Content-Type", "application/cbor")
+        .header("Accept", "application/cbor")
+        .body(Body::from(payload))
+        .unwrap();
+    let response = test_app(None).oneshot(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = ciborium::from_reader(body.as_ref()).unwrap();
+    for result in json.as_array().unwrap() {
+        verify_randomness_body(&serde_json::to_vec(result).unwrap().into(), points.len());
+    }
+}
+
+#[tokio::test]
+async fn alternate_point_encodings() {
+    use base64::prelude::{BASE64_STANDARD_NO_PAD, BASE64_URL_SAFE};
+
+    // Pick a point whose encoding differs between the variants.
+    let point = make_points(64)
+        .into_iter()
+        .find(|p| p.contains(['+', '/']))
+        .unwrap();
+    let bytes = BASE64.decode(&point).unwrap();
+    let encodings = [
+        point.clone(),
+        BASE64_URL_SAFE.encode(&bytes),
+        BASE64_STANDARD_NO_PAD.encode(&bytes),
+    ];
+    assert!(encodings[1] != point && encodings[2] != point);
+
+    let mut app = test_app(None);
+    let mut outputs = Vec::new();
+    for encoded in encodings {
+        let payload = json!({ "points": [encoded] }).to_string();
+        let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        outputs.push(json["points"][0].as_str().unwrap().to_string());
+    }
+    // Outputs are always standard base64.
+    assert_eq!(outputs[0], outputs[1]);
+    assert_eq!(outputs[0], outputs[2]);
+    assert_eq!(BASE64.decode(&outputs[0]).unwrap().len(), 32);
+
+    // Different encodings of a point are still duplicates.
+    let payload = json!({
+        "points": [point, BASE64_URL_SAFE.encode(&bytes)],
+        "require_distinct": true,
+    })
+    .to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::UNPROCESSABLE_ENTITY);
+}
+
+#[tokio::test]
+async fn hex_points() {
+    let points = make_points(2);
+    let hex = |bytes: &[u8]| bytes.iter().map(|b| format!("{b:02x}")).collect::<String>();
+    let hex_points: Vec<_> = points
+        .iter()
+        .map(|p| hex(&BASE64.decode(p).unwrap()))
+        .collect();
+
+    let mut app = test_app(None);
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let base64: Value = serde_json::from_slice(&body).unwrap();
+
+    let payload = json!({ "points": hex_points, "encoding": "hex" }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    for (output, expected) in json["points"].as_array().unwrap().iter().zip(
+        base64["points"].as_array().unwrap(),
+    ) {
+        let expected = BASE64.decode(expected.as_str().unwrap()).unwrap();
+        assert_eq!(output.as_str().unwrap(), hex(&expected));
+    }
+
+    // Every other binary field follows the encoding too.
+    let fields = json!({
+        "points": points,
+        "include_shuffle_seed": true,
+        "include_key_commitment": true,
+        "verifiable": true,
+    });
+    let response = app.call(test_request("/randomness", Some(fields.to_string()))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let base64: Value = serde_json::from_slice(&body).unwrap();
+    let mut fields = fields;
+    fields["points"] = json!(hex_points);
+    fields["encoding"] = json!("hex");
+    let response = app.call(test_request("/randomness", Some(fields.to_string()))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    for field in ["shuffle_seed", "key_commitment"] {
+        let expected = BASE64.decode(base64[field].as_str().unwrap()).unwrap();
+        assert_eq!(json[field].as_str().unwrap(), hex(&expected));
+    }
+    let proof = json["proofs"][0].as_str().unwrap();
+    let expected = BASE64.decode(base64["proofs"][0].as_str().unwrap()).unwrap();
+    assert_eq!(proof.len(), expected.len() * 2);
+    assert!(proof.bytes().all(|c| c.is_ascii_hexdigit()));
+
+    // Invalid hex is rejected like invalid base64.
+    let bad = "zz".repeat(32);
+    let payload = json!({ "points": [bad], "encoding": "hex" }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["message"], "Invalid point");
+}
+
+#[tokio::test]
+async fn bad_point_index() {
+    let mut app = test_app(None);
+
+    // Points of the wrong length are caught before decoding.
+    let mut points = make_points(4);
+    points[2] = "too short".to_string();
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json, json!({ "message": "Invalid point", "index": 2 }));
+
+    // As are points which fail to decode.
+    let mut points = make_points(4);
+    points[3] = "!".repeat(44);
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["index"], 3);
+    assert!(json["message"].as_str().unwrap().starts_with("Invalid base64"));
+}
+
+#[tokio::test]
+async fn partial_randomness() {
+    let mut app = test_app(None);
+
+    let mut points = make_points(5);
+    points[1] = "too short".to_string();
+    points[3] = "!".repeat(44);
+    let payload = json!({ "points": points, "partial": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["points"].as_array().unwrap().len(), 3);
+    assert_eq!(json["indices"], json!([0, 2, 4]));
+    let errors = json["errors"].as_array().unwrap();
+    assert_eq!(errors.len(), 2);
+    assert_eq!(errors[0], json!({ "message": "Invalid point", "index": 1 }));
+    assert_eq!(errors[1]["index"], 3);
+
+    // The outputs match those of a request holding only the valid points.
+    let valid: Vec<_> = [0, 2, 4].iter().map(|&i| points[i].clone()).collect();
+    let payload = json!({ "points": valid }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let full: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(full["points"], json["points"]);
+    assert!(full.get("indices").is_none());
+    assert!(full.get("errors").is_none());
+
+    // A partial request with only valid points has no errors.
+    let payload = json!({ "points": make_points(2), "partial": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["indices"], json!([0, 1]));
+    assert_eq!(json["errors"], json!([]));
+
+    // Without partial mode, the request fails as a whole.
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+/// Confirm partial requests report evaluation failures per point
+#[tokio::test]
+async fn partial_eval_errors() {
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    // Puncture the key behind the instance's back, so evaluation
+    // fails for points which decode.
+    oprf_state.instances["main"]
+        .write()
+        .unwrap()
+        .server
+        .puncture(EPOCH)
+        .unwrap();
+
+    let mut points = make_points(3);
+    points[1] = "too short".to_string();
+    let payload = json!({ "points": points, "partial": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["points"], json!([]));
+    assert_eq!(json["indices"], json!([]));
+    let indices: Vec<_> = json["errors"]
+        .as_array()
+        .unwrap()
+        .iter()
+        .map(|error| error["index"].clone())
+        .collect();
+    assert_eq!(indices, [0, 1, 2]);
+
+    // Without partial mode, the request fails as a whole.
+    let payload = json!({ "points": make_points(2) }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::INTERNAL_SERVER_ERROR);
+}
+
+/// Confirm `/info` lists recent keys, up to the configured limit
+#[tokio::test]
+async fn key_history() {
+    let config = crate::Config {
+        key_history_size: 2,
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+
+    let mut keys = Vec::new();
+    for rotations in 0..3 {
+        let response = app.call(test_request("/info", None)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let info: Value = serde_json::from_slice(&body).unwrap();
+        keys.push(info["publicKey"].clone());
+
+        // The history ends with the current key, and keeps the
+        // previous one once the key has been rotated.
+        let history = info["keyHistory"].as_array().unwrap();
+        assert_eq!(history.len(), if rotations == 0 { 1 } else { 2 });
+        let current = history.last().unwrap();
+        assert_eq!(current["publicKey"], info["publicKey"]);
+        assert_eq!(current["epoch"], EPOCH);
+        if rotations > 0 {
+            assert_eq!(history[0]["publicKey"], keys[rotations - 1]);
+        }
+
+        oprf_state.instances["main"]
+            .write()
+            .unwrap()
+            .rotate_key(&config)
+            .unwrap();
+    }
+    assert_ne!(keys[0], keys[1]);
+}
+
+/// Confirm `/info` publishes the key for the next epoch before
+/// the key is rotated
+#[tokio::test]
+async fn next_public_key() {
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+
+    let mut next_key = Value::Null;
+    for epoch in EPOCH..=EPOCH * 2 {
+        let response = app.call(test_request("/info", None)).await.unwrap();
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let info: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(info["currentEpoch"], epoch);
+        // The key only changes once the epochs are exhausted.
+        if epoch < EPOCH * 2 {
+            assert_eq!(info["nextPublicKey"], info["publicKey"]);
+        } else {
+            assert_ne!(info["nextPublicKey"], info["publicKey"]);
+        }
+        next_key = info["nextPublicKey"].clone();
+        oprf_state.instances["main"]
+            .write()
+            .unwrap()
+            .advance_epoch(&config)
+            .unwrap();
+    }
+
+    // After the rotation the published key takes effect.
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(info["currentEpoch"], EPOCH);
+    assert_eq!(info["publicKey"], next_key);
+}
+
+/// Confirm `/info` reports the fingerprint of the current key,
+/// and that it changes when the key is rotated
+#[tokio::test]
+async fn public_key_fingerprint() {
+    use sha2::Digest;
+
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+
+    let mut fingerprints = Vec::new();
+    for _ in 0..2 {
+        let response = app.call(test_request("/info", None)).await.unwrap();
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let info: Value = serde_json::from_slice(&body).unwrap();
+        let public_key = BASE64.decode(info["publicKey"].as_str().unwrap()).unwrap();
+        let expected: String = Sha256::digest(public_key)
+            .iter()
+            .map(|byte| format!("{byte:02x}"))
+            .collect();
+        assert_eq!(info["publicKeyFingerprint"], expected);
+        fingerprints.push(expected);
+
+        oprf_state.instances["main"]
+            .write()
+            .unwrap()
+            .rotate_key(&config)
+            .unwrap();
+    }
+    assert_ne!(fingerprints[0], fingerprints[1]);
+}
+
+/// Confirm `/info` reports the time to the next epoch relative to
+/// the server's own clock
+#[tokio::test]
+async fn seconds_until_next_epoch() {
+    let config = crate::Config {
+        epoch_durations: vec!["10s".into()],
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+
+    // Nothing is reported until the schedule is running.
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    assert!(info["secondsUntilNextEpoch"].is_null());
+    assert!(info["epochLenSeconds"].is_null());
+
+    oprf_state.start_background_tasks(&config).unwrap();
+    wait_for_schedule(&oprf_state).await;
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(info["epochLenSeconds"], 10);
+    let remaining = info["secondsUntilNextEpoch"].as_i64().unwrap();
+    assert!((0..=10).contains(&remaining));
+    oprf_state.stop_background_tasks();
+}
+
+/// Confirm `/info?at=` reports the epoch in effect at that time
+#[tokio::test]
+async fn info_at() {
+    use time::format_description::well_known::Rfc3339;
+
+    let base = (OffsetDateTime::now_utc() - Duration::from_secs(5))
+        .replace_millisecond(0)
+        .unwrap();
+    let config = crate::Config {
+        epoch_base_time: Some(base),
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    oprf_state.start_background_tasks(&config).unwrap();
+    wait_for_schedule(&oprf_state).await;
+    let mut app = crate::app(oprf_state.clone());
+
+    let at = |offset: f64| {
+        let at = (base + Duration::from_secs_f64(offset)).format(&Rfc3339).unwrap();
+        test_request(&format!("/info?at={at}"), None)
+    };
+
+    for (offset, epoch) in [(2.5, EPOCH + 2), (13.5, EPOCH + 1)] {
+        let response = app.call(at(offset)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let info: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(info["currentEpoch"], epoch);
+        assert_eq!(info["remainingEpochs"], EPOCH * 2 - epoch);
+        let next = (base + Duration::from_secs_f64(offset.ceil()))
+            .format(&Rfc3339)
+            .unwrap();
+        assert_eq!(info["nextEpochTime"], next);
+        assert_eq!(info["epochLenSeconds"], 1);
+    }
+
+    // Times months ahead are located without stepping through
+    // each epoch on the way.
+    let offset = 200.0 * 86400.0 + 3.5;
+    let response = app.call(at(offset)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    let epoch = EPOCH + ((offset.ceil() as u64 - 1) % (EPOCH as u64 + 1)) as u8;
+    assert_eq!(info["currentEpoch"], epoch);
+
+    // Times before the base time, too far ahead, or malformed,
+    // are rejected.
+    let response = app.call(at(-1.0)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let response = app
+        .call(test_request("/info?at=9999-12-31T23:59:59Z", None))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let response = app.call(test_request("/info?at=yesterday", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    oprf_state.stop_background_tasks();
+}
+
+/// Confirm requests keep succeeding while the key is rotated,
+/// with the next key prepared off to the side
+#[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+async fn rotation_under_load() {
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let app = crate::app(oprf_state.clone());
+
+    let load = tokio::spawn(async move {
+        let payload = json!({ "points": make_points(8) }).to_string();
+        for _ in 0..200 {
+            let request = test_request("/randomness", Some(payload.clone()));
+            let response = app.clone().oneshot(request).await.unwrap();
+            assert_eq!(response.status(), StatusCode::OK);
+            let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+            verify_randomness_body(&body, 8);
+        }
+    });
+
+    let instance = &oprf_state.instances["main"];
+    for _ in 0..10 {
+        instance.write().unwrap().rotate_key(&config).unwrap();
+        // The consumed key is replaced without holding the lock.
+        assert!(instance.read().unwrap().next_server.is_none());
+        crate::state::prepare_next_key(instance, &config).await;
+        assert!(instance.read().unwrap().next_server.is_some());
+        tokio::task::yield_now().await;
+    }
+    load.await.unwrap();
+}
+
+/// Confirm instances can evaluate batches directly, matching
+/// the outputs served over HTTP
+#[tokio::test]
+async fn instance_eval() {
+    use ppoprf::ppoprf::Point;
+
+    let config = test_config(None);
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    let points = make_points(4);
+    let inputs: Vec<Point> = points
+        .iter()
+        .map(|p| Point::from(BASE64.decode(p).unwrap().as_slice()))
+        .collect();
+
+    let instance = oprf_state.instances["main"].read().unwrap();
+    let evaluations = instance.eval(&inputs, EPOCH, false, None).unwrap();
+    assert_eq!(evaluations.len(), 4);
+    assert!(evaluations.iter().all(|e| e.proof.is_none()));
+    let outputs: Vec<String> = evaluations
+        .iter()
+        .map(|e| BASE64.encode(e.output.as_bytes()))
+        .collect();
+    let evaluations = instance.eval(&inputs, EPOCH, true, None).unwrap();
+    assert!(evaluations.iter().all(|e| e.proof.is_some()));
+    drop(instance);
+
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["points"], json!(outputs));
+
+    // Once the deadline has passed, no more points are evaluated.
+    let mut instance = oprf_state.instances["main"].write().unwrap();
+    let deadline = Some(std::time::Instant::now());
+    let error = instance.eval(&inputs, EPOCH, false, deadline).unwrap_err();
+    assert!(matches!(error, crate::state::EvalError::TimedOut));
+
+    // Failures report the index of the point within the batch.
+    instance.puncture(EPOCH).unwrap();
+    let error = instance.eval(&inputs, EPOCH, false, None).unwrap_err();
+    assert!(matches!(error, crate::state::EvalError::Failed { index: 0, .. }));
+}
+
+/// Confirm the epoch schedule follows the server's clock, so it
+/// can be tested at exact times
+#[tokio::test]
+async fn injected_clock() {
+    use time::format_description::well_known::Rfc3339;
+
+    let base = OffsetDateTime::parse(NEXT_EPOCH_TIME, &Rfc3339).unwrap();
+    let config = crate::Config {
+        epoch_durations: vec!["10s".into()],
+        epoch_base_time: Some(base),
+        ..test_config(None)
+    };
+    let now = base + Duration::from_secs(35);
+    let oprf_state = OPRFServer::with_clock(&config, std::sync::Arc::new(move || now));
+    oprf_state.start_background_tasks(&config).unwrap();
+    wait_for_schedule(&oprf_state).await;
+    let mut app = crate::app(oprf_state.clone());
+
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(info["currentEpoch"], EPOCH + 3);
+    let next = (base + Duration::from_secs(40)).format(&Rfc3339).unwrap();
+    assert_eq!(info["nextEpochTime"], next);
+    assert_eq!(info["secondsUntilNextEpoch"], 5);
+
+    // The key changes when the remaining epochs are exhausted.
+    let response = app.call(test_request("/status", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let status: Value = serde_json::from_slice(&body).unwrap();
+    let remaining = (EPOCH * 2 - (EPOCH + 3)) as i64;
+    assert_eq!(status["secondsUntilKeyChange"], 5 + 10 * remaining);
+    oprf_state.stop_background_tasks();
+}
+
+/// Confirm a panicking handler gets a JSON 500 response rather
+/// than a dropped connection
+#[tokio::test]
+async fn panic_response() {
+    use axum::routing::get;
+    use tower_http::catch_panic::CatchPanicLayer;
+
+    async fn buggy() -> StatusCode {
+        panic!("handler bug")
+    }
+    let mut app: axum::Router = axum::Router::new()
+        .route("/panic", get(buggy))
+        .layer(CatchPanicLayer::custom(crate::handler::panic_response));
+    let response = app.call(test_request("/panic", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::INTERNAL_SERVER_ERROR);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json, json!({ "message": "Internal server error" }));
+}
+
+/// Confirm requests rejected before reaching a handler still get
+/// a JSON error body
+#[tokio::test]
+async fn json_rejections() {
+    let mut app = test_app(None);
+
+    let requests = [
+        test_request("/schedule?limit=many", None),
+        test_request("/epoch-span?from=2023-03-22T21:46:35Z", None),
+        test_request("/randomness/multi", Some("[{".to_string())),
+        test_request("/verify", Some(json!({ "input": 1 }).to_string())),
+    ];
+    for request in requests {
+        let uri = request.uri().clone();
+        let response = app.call(request).await.unwrap();
+        assert!(response.status().is_client_error(), "{uri}");
+        let content_type = response.headers()[axum::http::header::CONTENT_TYPE].clone();
+        assert_eq!(content_type, "application/json", "{uri}");
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert!(json["message"].is_string(), "{uri}");
+    }
+
+    // Messages keep the detail axum gives in its own responses.
+    let request = test_request("/randomness/multi", Some("[{".to_string()));
+    let response = app.call(request).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let message = json["message"].as_str().unwrap();
+    assert!(message.starts_with("Failed to parse the request body as JSON: "));
+}
+
+/// Confirm evaluations exceeding the time limit are abandoned
+#[tokio::test]
+async fn eval_timeout() {
+    let points = make_points(crate::DEFAULT_MAX_POINTS);
+    let payload = json!({ "points": points }).to_string();
+
+    // The deadline is checked before each point is evaluated, so
+    // no time at all always expires first.
+    let config = crate::Config {
+        eval_timeout_ms: Some(0),
+        max_concurrent: Some(1),
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    let raw: Vec<u8> = points.iter().flat_map(|p| BASE64.decode(p).unwrap()).collect();
+    let requests = [
+        test_request("/randomness", Some(payload.clone())),
+        test_request("/randomness/multi", Some(format!("[{payload}]"))),
+        Request::builder()
+            .uri("/randomness/raw")
+            .method("POST")
+            .body(Body::from(raw))
+            .unwrap(),
+    ];
+    for request in requests {
+        let response = app.call(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(response.headers()[axum::http::header::RETRY_AFTER], "1");
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["message"], "Timed out evaluating points");
+        // The evaluation has stopped, releasing its slot.
+        let permits = oprf_state.eval_permits.as_ref().unwrap();
+        assert_eq!(permits.available_permits(), 1);
+    }
+
+    // A generous limit doesn't affect the result.
+    let config = crate::Config {
+        eval_timeout_ms: Some(60_000),
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    verify_randomness_body(&body, crate::DEFAULT_MAX_POINTS);
+}
+
+/// Confirm requests beyond the concurrency limit are shed
+#[tokio::test]
+async fn max_concurrent() {
+    let config = crate::Config {
+        max_concurrent: Some(1),
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    let payload = json!({ "points": make_points(2) }).to_string();
+
+    // Take the only slot, as a request in progress would.
+    let permits = oprf_state.eval_permits.clone().unwrap();
+    let permit = permits.try_acquire_owned().unwrap();
+    let request = test_request("/randomness", Some(payload.clone()));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+    assert_eq!(response.headers()[axum::http::header::RETRY_AFTER], "1");
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["message"], "Too many concurrent requests");
+
+    // Requests are served again once the slot is released.
+    drop(permit);
+    let request = test_request("/randomness", Some(payload));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    verify_randomness_body(&body, 2);
+}
+
+/// Confirm each client's randomness requests are rate limited,
+/// and allowed again once its bucket refills
+/// Buckets follow the monotonic clock, which is paused here.
+#[tokio::test(start_paused = true)]
+async fn rate_limit() {
+    use axum::extract::ConnectInfo;
+    use std::net::SocketAddr;
+
+    let config = crate::Config {
+        rate_limit: Some(0.5),
+        rate_burst: 2,
+        ..test_config(None)
+    };
+    let oprf_state = OPRFServer::new(&config);
+    let mut app = crate::app(oprf_state.clone());
+    let payload = json!({ "points": make_points(1) }).to_string();
+    let request_from = |addr: &str| {
+        let mut request = test_request("/randomness", Some(payload.clone()));
+        let addr: SocketAddr = addr.parse().unwrap();
+        request.extensions_mut().insert(ConnectInfo(addr));
+        request
+    };
+
+    // A burst is allowed.
+    for _ in 0..2 {
+        let response = app.call(request_from("192.0.2.1:1234")).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+    }
+    // Beyond it the client is throttled, from any port.
+    let response = app.call(request_from("192.0.2.1:5678")).await.unwrap();
+    assert_eq!(response.status(), StatusCode::TOO_MANY_REQUESTS);
+    assert_eq!(response.headers()[axum::http::header::RETRY_AFTER], "2");
+    // Other clients are unaffected.
+    let response = app.call(request_from("192.0.2.2:1234")).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    // Other endpoints aren't limited.
+    let mut request = test_request("/info", None);
+    let addr: SocketAddr = "192.0.2.1:1234".parse().unwrap();
+    request.extensions_mut().insert(ConnectInfo(addr));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // The client recovers once a token has been earned.
+    tokio::time::advance(Duration::from_secs(2)).await;
+    let response = app.call(request_from("192.0.2.1:1234")).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let response = app.call(request_from("192.0.2.1:1234")).await.unwrap();
+    assert_eq!(response.status(), StatusCode::TOO_MANY_REQUESTS);
+
+    // Clients are forgotten once their buckets are full again.
+    let limiter = oprf_state.rate_limiter.as_ref().unwrap();
+    assert_eq!(limiter.client_count(), 2);
+    let later = tokio::time::Instant::now() + Duration::from_secs(1);
+    limiter.collect_garbage(later);
+    assert_eq!(limiter.client_count(), 1);
+    limiter.collect_garbage(later + Duration::from_secs(4));
+    assert_eq!(limiter.client_count(), 0);
+}
+
+/// Confirm IPv6 clients share a bucket across their /64, and the
+/// number of clients tracked is bounded
+#[test]
+fn rate_limit_clients() {
+    use crate::state::RateLimiter;
+
+    let now = tokio::time::Instant::now();
+    let limiter = RateLimiter::new(1.0, 1, 2, Duration::from_secs(600));
+    let client = |addr: &str| addr.parse().unwrap();
+    assert!(limiter.check(client("2001:db8:1:2::1"), now).is_ok());
+    assert!(limiter.check(client("2001:db8:1:2:ffff::1"), now).is_err());
+    assert!(limiter.check(client("2001:db8:1:3::1"), now).is_ok());
+    // IPv4-mapped addresses count as the IPv4 client.
+    assert!(limiter.check(client("192.0.2.1"), now).is_ok());
+    assert!(limiter.check(client("::ffff:192.0.2.1"), now).is_err());
+    assert_eq!(limiter.client_count(), 2);
+
+    // The least recently seen client makes room for new ones, and
+    // starts afresh if it returns.
+    assert!(limiter.check(client("2001:db8:1:3::1"), now).is_err());
+    assert!(limiter.check(client("192.0.2.2"), now).is_ok());
+    assert_eq!(limiter.client_count(), 2);
+    assert!(limiter.check(client("2001:db8:1:3::1"), now).is_err());
+    assert!(limiter.check(client("192.0.2.1"), now).is_ok());
+    assert_eq!(limiter.client_count(), 2);
+}
+
+/// Confirm the info and verify endpoints have their own limits,
+/// each exhausted without affecting the others
+#[tokio::test(start_paused = true)]
+async fn rate_limit_endpoints() {
+    use axum::extract::ConnectInfo;
+    use std::net::SocketAddr;
+
+    let config = crate::Config {
+        rate_limit: Some(0.5),
+        info_rate_limit: Some(0.5),
+        verify_rate_limit: Some(0.5),
+        rate_burst: 2,
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    let from_client = |mut request: Request<Body>| {
+        let addr: SocketAddr = "192.0.2.1:1234".parse().unwrap();
+        request.extensions_mut().insert(ConnectInfo(addr));
+        request
+    };
+
+    let points = make_points(1);
+    let payload = json!({ "points": points, "verifiable": true }).to_string();
+    let request = from_client(test_request("/randomness", Some(payload)));
+    let response = app.call(request).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let verify = json!({
+        "input": points[0],
+        "output": json["points"][0],
+        "proof": json["proofs"][0],
+        "epoch": json["epoch"],
+        "generation": 0,
+    })
+    .to_string();
+    let info = || from_client(test_request("/info", None));
+    let verify = || from_client(test_request("/verify", Some(verify.clone())));
+
+    // Exhausting the verify bucket leaves info requests alone.
+    for _ in 0..2 {
+        let response = app.call(verify()).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+    }
+    let response = app.call(verify()).await.unwrap();
+    assert_eq!(response.status(), StatusCode::TOO_MANY_REQUESTS);
+    assert_eq!(response.headers()[axum::http::header::RETRY_AFTER], "2");
+    let response = app.call(info()).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // And the other way round, once verify recovers.
+    tokio::time::advance(Duration::from_secs(2)).await;
+    for _ in 0..2 {
+        let response = app.call(info()).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+    }
+    let response = app.call(info()).await.unwrap();
+    assert_eq!(response.status(), StatusCode::TOO_MANY_REQUESTS);
+    let response = app.call(verify()).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // Neither touches the randomness bucket.
+    let payload = json!({ "points": points }).to_string();
+    let request = from_client(test_request("/randomness", Some(payload)));
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+}
+
+/// Confirm the cleanup task forgets idle clients on its interval,
+/// even before their buckets refill, and stops with the others
+#[tokio::test(start_paused = true)]
+async fn rate_limit_reaper() {
+    let config = crate::Config {
+        rate_limit: Some(0.001),
+        rate_burst: 1,
+        rate_limit_idle_ms: 5_000,
+        rate_limit_gc_interval_ms: 1_000,
+        ..test_config(Some(vec![InstanceConfig {
+            instance_name: "main".to_string(),
+            epoch_duration: "1h".to_string(),
+        }]))
+    };
+    let oprf_state = OPRFServer::new(&config);
+    let limiter = oprf_state.rate_limiter.as_ref().unwrap();
+    let idle = "192.0.2.1".parse().unwrap();
+    let active = "192.0.2.2".parse().unwrap();
+    assert!(limiter.check(idle, tokio::time::Instant::now()).is_ok());
+    assert!(limiter.check(active, tokio::time::Instant::now()).is_ok());
+    oprf_state.start_background_tasks(&config).unwrap();
+
+    // Sleeping on the paused clock runs the cleanup task through
+    // every tick due first. Waking between ticks keeps the order
+    // unambiguous.
+    tokio::time::sleep(Duration::from_millis(3_500)).await;
+    assert_eq!(limiter.client_count(), 2);
+    assert!(limiter.check(active, tokio::time::Instant::now()).is_err());
+    tokio::time::sleep(Duration::from_secs(3)).await;
+    assert_eq!(limiter.client_count(), 1);
+    assert!(limiter.check(active, tokio::time::Instant::now()).is_err());
+
+    // Nothing is reaped once the task has stopped.
+    oprf_state.stop_background_tasks();
+    tokio::time::sleep(Duration::from_secs(10)).await;
+    assert_eq!(limiter.client_count(), 1);
+}
+
+/// Confirm clients are identified by the trusted proxy header
+#[tokio::test]
+async fn rate_limit_proxy_header() {
+    let config = crate::Config {
+        rate_limit: Some(1.0),
+        rate_burst: 1,
+        client_ip_header: Some("X-Forwarded-For".to_string()),
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    let payload = json!({ "points": make_points(1) }).to_string();
+    let request_from = |forwarded: &str| {
+        let mut request = test_request("/randomness", Some(payload.clone()));
+        let value = forwarded.parse().unwrap();
+        request.headers_mut().insert("X-Forwarded-For", value);
+        request
+    };
+
+    let response = app.call(request_from("192.0.2.1")).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    // Only the address added by the proxy counts.
+    let response = app
+        .call(request_from("198.51.100.7, 192.0.2.1"))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::TOO_MANY_REQUESTS);
+    let response = app
+        .call(request_from("192.0.2.1, 192.0.2.2"))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+}
+
+/// Confirm randomness requires the bearer token when one is set,
+/// while info stays public
+#[tokio::test]
+async fn auth_token() {
+    let path = std::env::temp_dir().join(format!("star-randsrv-auth-{}", std::process::id()));
+    std::fs::write(&path, "t0ken\n").unwrap();
+    let config = crate::Config {
+        auth_token_file: Some(path.clone()),
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    std::fs::remove_file(&path).unwrap();
+
+    let payload = json!({ "points": make_points(2) }).to_string();
+    let randomness = |uri: &str, token: Option<&str>| {
+        let mut request = test_request(uri, Some(payload.clone()));
+        if let Some(token) = token {
+            let value = format!("Bearer {token}").parse().unwrap();
+            request.headers_mut().insert("Authorization", value);
+        }
+        request
+    };
+
+    for uri in ["/randomness", "/instances/main/randomness"] {
+        let response = app.call(randomness(uri, None)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["message"], "Missing or invalid bearer token");
+        let response = app.call(randomness(uri, Some("t0ke"))).await.unwrap();
+        assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+        let response = app.call(randomness(uri, Some("t0ken"))).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+        verify_randomness_body(&body, 2);
+    }
+
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+}
+
+/// Confirm CORS preflight requests and cross-origin requests from
+/// allowed origins are answered with CORS headers
+#[tokio::test]
+async fn cors() {
+    use axum::http::header;
+
+    let config = crate::Config {
+        cors_origins: vec!["https://a.example".to_string(), "https://b.example".to_string()],
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    let preflight = |origin: &str| {
+        Request::builder()
+            .method("OPTIONS")
+            .uri("/randomness")
+            .header(header::ORIGIN, origin)
+            .header(header::ACCESS_CONTROL_REQUEST_METHOD, "POST")
+            .header(header::ACCESS_CONTROL_REQUEST_HEADERS, "content-type")
+            .body(Body::empty())
+            .unwrap()
+    };
+
+    let response = app.call(preflight("https://b.example")).await.unwrap();
+    assert_eq!(response.status(), StatusCode::NO_CONTENT);
+    let headers = response.headers();
+    assert_eq!(headers[header::ACCESS_CONTROL_ALLOW_ORIGIN], "https://b.example");
+    let methods = headers[header::ACCESS_CONTROL_ALLOW_METHODS].to_str().unwrap();
+    assert!(methods.contains("POST"));
+    let allowed = headers[header::ACCESS_CONTROL_ALLOW_HEADERS].to_str().unwrap();
+    assert!(allowed.to_lowercase().contains("content-type"));
+    assert_eq!(headers[header::VARY], "Origin");
+
+    let payload = json!({ "points": make_points(2) }).to_string();
+    let mut request = test_request("/randomness", Some(payload.clone()));
+    let origin = "https://a.example".parse().unwrap();
+    request.headers_mut().insert(header::ORIGIN, origin);
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let headers = response.headers();
+    assert_eq!(headers[header::ACCESS_CONTROL_ALLOW_ORIGIN], "https://a.example");
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    verify_randomness_body(&body, 2);
+
+    // Other origins get no CORS headers.
+    let response = app.call(preflight("https://c.example")).await.unwrap();
+    assert_ne!(response.status(), StatusCode::NO_CONTENT);
+    assert!(!response
+        .headers()
+        .contains_key(header::ACCESS_CONTROL_ALLOW_ORIGIN));
+    let mut request = test_request("/info", None);
+    let origin = "https://c.example".parse().unwrap();
+    request.headers_mut().insert(header::ORIGIN, origin);
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    assert!(!response
+        .headers()
+        .contains_key(header::ACCESS_CONTROL_ALLOW_ORIGIN));
+
+    // A wildcard allows any origin.
+    let config = crate::Config {
+        cors_origins: vec!["*".to_string()],
+        ..test_config(None)
+    };
+    let mut app = crate::app(OPRFServer::new(&config));
+    let response = app.call(preflight("https://c.example")).await.unwrap();
+    assert_eq!(response.status(), StatusCode::NO_CONTENT);
+    assert_eq!(response.headers()[header::ACCESS_CONTROL_ALLOW_ORIGIN], "*");
+}
+
+#[tokio::test]
+async fn version() {
+    let app = test_app(None);
+    let response = app.oneshot(test_request("/version", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["version"], env!("CARGO_PKG_VERSION"));
+    assert!(json["rustcVersion"].as_str().unwrap().starts_with("rustc "));
+    assert!(!json["ppoprfVersion"].as_str().unwrap().is_empty());
+    assert!(json.get("gitCommit").is_some());
+    assert!(json.get("buildTime").is_some());
+}
+
+/// Confirm outputs are the length reported by /info, in every format
+#[tokio::test]
+async fn output_length() {
+    let mut app = test_app(None);
+    let response = app.call(test_request("/info", None)).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let info: Value = serde_json::from_slice(&body).unwrap();
+    let length = info["outputLength"].as_u64().unwrap() as usize;
+    assert_eq!(length, crate::handler::OUTPUT_LENGTH);
+
+    let points = make_points(3);
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    for point in json["points"].as_array().unwrap() {
+        let output = BASE64.decode(point.as_str().unwrap()).unwrap();
+        assert_eq!(output.len(), length);
+    }
+
+    let hex: Vec<String> = points
+        .iter()
+        .map(|p| BASE64.decode(p).unwrap().iter().map(|b| format!("{b:02x}")).collect())
+        .collect();
+    let payload = json!({ "points": hex, "encoding": "hex" }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    for point in json["points"].as_array().unwrap() {
+        assert_eq!(point.as_str().unwrap().len(), 2 * length);
+    }
+
+    // HKDF output has the requested length instead.
+    let payload = json!({
+        "points": hex,
+        "encoding": "hex",
+        "hkdf": { "salt": BASE64.encode(b"salt"), "length": 48 },
+    });
+    let response = app.call(test_request("/randomness", Some(payload.to_string()))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    for point in json["points"].as_array().unwrap() {
+        assert_eq!(point.as_str().unwrap().len(), 2 * 48);
+    }
+
+    let raw: Vec<u8> = points.iter().flat_map(|p| BASE64.decode(p).unwrap()).collect();
+    let request = Request::builder()
+        .uri("/randomness/raw")
+        .method("POST")
+        .body(Body::from(raw))
+        .unwrap();
+    let response = app.call(request).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    assert_eq!(body.len(), 1 + 4 + points.len() * length);
+}
+
+/// Confirm the ciphersuite reported by /info matches the linked
+/// ppoprf, so the constants are revisited whenever it changes
+#[tokio::test]
+async fn ciphersuite() {
+    // CURVE and HASH were checked against this release series.
+    let ppoprf_version = env!("STAR_RANDSRV_PPOPRF_VERSION");
+    assert!(
+        ppoprf_version.starts_with("0.3."),
+        "check the reported ciphersuite against ppoprf {ppoprf_version}"
+    );
+    assert_eq!(crate::handler::CURVE, "ristretto255");
+    assert_eq!(crate::handler::OUTPUT_LENGTH, 32);
+
+    // Outputs are the reported length, and valid group elements.
+    let app = test_app(None);
+    let payload = json!({ "points": make_points(4) }).to_string();
+    let response = app.oneshot(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    for point in json["points"].as_array().unwrap() {
+        let output = BASE64.decode(point.as_str().unwrap()).unwrap();
+        assert_eq!(output.len(), crate::handler::OUTPUT_LENGTH);
+        let output = CompressedRistretto::from_slice(&output).unwrap();
+        assert!(output.decompress().is_some());
+    }
+}
+
+/// Confirm the identity element is rejected as an input
+#[tokio::test]
+async fn identity_point() {
+    let mut app = test_app(None);
+    let identity = [0u8; 32];
+    let mut points = make_points(2);
+    points.insert(1, BASE64.encode(identity));
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["message"], "input point is the identity element");
+    assert_eq!(json["index"], 1);
+
+    let payload = json!({ "points": ["00".repeat(32)], "encoding": "hex" }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+
+    let request = Request::builder()
+        .uri("/randomness/raw")
+        .method("POST")
+        .body(Body::from(identity.to_vec()))
+        .unwrap();
+    let response = app.call(request).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+}
+
+/// Confirm repeated points get one output per position, matching
+/// the output for the point alone
+#[tokio::test]
+async fn duplicate_points() {
+    let mut app = test_app(None);
+    let unique = make_points(2);
+    let points = vec![
+        unique[0].clone(),
+        unique[1].clone(),
+        unique[0].clone(),
+        unique[0].clone(),
+    ];
+
+    let payload = json!({ "points": points }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    let outputs = json["points"].as_array().unwrap();
+    assert_eq!(outputs.len(), 4);
+    assert_eq!(outputs[0], outputs[2]);
+    assert_eq!(outputs[0], outputs[3]);
+    assert_ne!(outputs[0], outputs[1]);
+
+    let payload = json!({ "points": [unique[0]] }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["points"][0], outputs[0]);
+
+    // Verifiable requests still get a proof for every position.
+    let payload = json!({ "points": points, "verifiable": true }).to_string();
+    let response = app.call(test_request("/randomness", Some(payload))).await.unwrap();
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert_eq!(json["points"].as_array().unwrap(), outputs);
+    assert_eq!(json["proofs"].as_array().unwrap().len(), 4);
+}
+
+#[tokio::test]
+async fn pprof_endpoints() {
+    let mut app = crate::pprof_app();
+    let response = app
+        .call(test_request("/debug/pprof/heap", None))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body = to_bytes(response.into_body(), RESPONSE_MAX).await.unwrap();
+    let json: Value = serde_json::from_slice(&body).unwrap();
+    assert!(json["allocatedBytes"].as_u64().unwrap() > 0);
+    assert!(json["residentBytes"].as_u64().unwrap() > 0);
+
+    // Profiles must be of a bounded duration.
+    for seconds in [0, 3600] {
+        let uri = format!("/debug/pprof/profile?seconds={seconds}");
+        let response = app.call(test_request(&uri, None)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    }
+
+    // Profiling isn't available from the main app.
+    let mut app = test_app(None);
+    let response = app
+        .call(test_request("/debug/pprof/heap", None))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::NOT_FOUND);
+}